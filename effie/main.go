@@ -1,27 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json/jsontext"
 	"encoding/json/v2"
+	"errors"
 	"sync"
+	"sync/atomic"
 
-	// "fmt"
-	"github.com/nxadm/tail"
+	"fmt"
 	"sigs.k8s.io/yaml"
 
-	// "io"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"strconv"
 
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/dop251/goja"
+	"github.com/klauspost/compress/zstd"
 	// "runtime/pprof"
 	// "github.com/httmako/jote"
 )
@@ -36,17 +52,66 @@ type Config struct {
 	JSMessageParser string
 	Input           []Input
 	ScanFrequency   int
+	SendRetries     int
+	RetryMaxDelay   int
+	SpoolDir        string
+	SpoolMaxBatches int
+	Token           string
+	TokenHeader     string
+	TLSCA           string
+	TLSCert         string
+	TLSKey          string
+	Compression     string
+	MetricsAddr     string
+	RotateWait      int
+	Kubernetes      Kubernetes
+}
+
+// Kubernetes configures the enrichment of container logs with pod labels and annotations from the kubernetes api.
+// The in-cluster service account is used if APIServer, TokenFile and CAFile are empty.
+type Kubernetes struct {
+	Enrich    bool
+	APIServer string
+	TokenFile string
+	CAFile    string
+	CacheTTL  int
 }
 
 type Input struct {
-	Type    string
-	Group   string
-	Pattern string
+	Type              string
+	Group             string
+	Pattern           string
+	Multiline         *Multiline
+	JSTransformer     string
+	JSTransformerFile string
+	Matches           []string
+	Listen            string
+	Protocol          string
+	Fields            map[string]any
+	Tags              []string
+	Exclude           []string
+	ReadCompressed    bool
+}
+
+// Multiline merges continuation lines (e.g. stack traces) into the event of the line before them.
+// Either StartPattern (a matching line starts a new event) or ContinuationPattern (a matching line continues the event) is used.
+type Multiline struct {
+	StartPattern        string
+	ContinuationPattern string
+	Negate              bool
+	MaxLines            int
+	FlushTimeout        int
 }
 
 type Log struct {
 	Ts  string `json:"ts"`
 	Doc string `json:"doc"`
+	// Journal and Cursor are set on the last log of a journald entry, the cursor is saved once the batch is acknowledged
+	Journal string `json:"-"`
+	Cursor  string `json:"-"`
+	// File (the FileKey) and Offset are set on the last log of a line, the offset is saved once the batch is acknowledged
+	File   string `json:"-"`
+	Offset int64  `json:"-"`
 }
 
 func getEnv(name string, def string) string {
@@ -67,44 +132,287 @@ func num(value string) int {
 
 var lastSendTime time.Time
 
-func Sending(logger *slog.Logger, logs []Log, target string) {
+var httpClient *http.Client
+
+// CreateHTTPClient creates the client used to send to setsuna.
+// TLSCA replaces the system CAs for verifying setsuna, TLSCert and TLSKey are the client certificate for mutual TLS.
+func CreateHTTPClient(cfg Config) *http.Client {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSCA != "" {
+		pem, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			panic(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic("no certificates found in " + cfg.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			panic(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 2 * time.Minute}
+}
+
+// Sending marshals the batch and blocks until it is acknowledged, either by setsuna or by the spool.
+// Only after Sending returns is it safe to save the progress of the tails.
+func Sending(logger *slog.Logger, logs []Log, cfg Config) {
 	j, err := json.Marshal(logs)
 	if err != nil {
 		logger.Error("error during marshal", "err", err)
 		return
 	}
-	for {
-		logger.Debug("Time since last send", "d", time.Since(lastSendTime))
-		lastSendTime = time.Now()
-		logger.Info("Posting", "lines", len(logs), "bytes", len(j))
-		res, err := http.Post(target, "application/json", bytes.NewReader(j))
-		if err != nil || res.StatusCode > 299 {
-			logger.Error("error during http post, retrying in 5s", "err", err)
+	logger.Debug("Time since last send", "d", time.Since(lastSendTime))
+	lastSendTime = time.Now()
+	logger.Info("Posting", "lines", len(logs), "bytes", len(j))
+	logger.Debug("Transformer counters", "emitted", TransformerEmitted.Load(), "dropped", TransformerDropped.Load(), "errors", TransformerErrors.Load())
+	for backoff := time.Second; ; backoff = min(backoff*2, time.Duration(cfg.RetryMaxDelay)*time.Second) {
+		// Older spooled batches have to be sent first to keep the order
+		if DrainSpool(logger, cfg) {
+			err = PostBatch(j, cfg)
+			if err == nil || IsRejected(logger, err) {
+				return
+			}
+			logger.Error("error during http post", "err", err)
+			if cfg.SpoolDir == "" {
+				logger.Error("no spool configured, retrying", "in", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			err = RetryPostBatch(logger, j, cfg)
+			if err == nil || IsRejected(logger, err) {
+				return
+			}
+		}
+		err = WriteSpool(cfg, j)
+		if err == nil {
+			logger.Warn("setsuna unreachable, batch spooled", "lines", len(logs), "bytes", len(j))
 			return
+		}
+		logger.Error("could not spool batch, retrying", "err", err, "in", backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// RetryPostBatch retries the post with an exponential backoff for cfg.SendRetries times.
+func RetryPostBatch(logger *slog.Logger, j []byte, cfg Config) error {
+	var err error
+	backoff := time.Second
+	for i := 0; i < cfg.SendRetries; i++ {
+		logger.Error("retrying http post", "attempt", i+1, "in", backoff)
+		time.Sleep(backoff)
+		err = PostBatch(j, cfg)
+		if err == nil || errors.As(err, new(*RejectedError)) {
+			return err
+		}
+		logger.Error("error during http post", "err", err)
+		backoff = min(backoff*2, time.Duration(cfg.RetryMaxDelay)*time.Second)
+	}
+	return err
+}
+
+// RejectedError is returned if setsuna refused the batch itself (malformed, too large or in an unsupported encoding).
+// Sending it again would fail the same way, so the batch is discarded instead of retried.
+type RejectedError struct {
+	Status int
+	Body   string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("setsuna rejected batch with status %d: %s", e.Status, e.Body)
+}
+
+var zstdEncoder *zstd.Encoder
+
+// Compress compresses the batch with the configured Compression and returns the Content-Encoding for it.
+func Compress(j []byte, compression string) ([]byte, string, error) {
+	switch compression {
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(j); err != nil {
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "gzip", nil
+	case "zstd":
+		return zstdEncoder.EncodeAll(j, nil), "zstd", nil
+	default:
+		return j, "", nil
+	}
+}
+
+func PostBatch(j []byte, cfg Config) error {
+	body, encoding, err := Compress(j, cfg.Compression)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", cfg.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if cfg.Token != "" {
+		if cfg.TokenHeader == "Authorization" {
+			req.Header.Set("Authorization", "Bearer "+cfg.Token)
 		} else {
-			return
+			req.Header.Set(cfg.TokenHeader, cfg.Token)
+		}
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode == 400 || res.StatusCode == 413 || res.StatusCode == 415 {
+		return &RejectedError{Status: res.StatusCode, Body: string(resBody)}
+	}
+	if res.StatusCode > 299 {
+		return fmt.Errorf("setsuna returned status %d: %s", res.StatusCode, resBody)
+	}
+	return nil
+}
+
+// IsRejected logs and returns true if setsuna rejected the batch, so it should be discarded.
+func IsRejected(logger *slog.Logger, err error) bool {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		logger.Error("discarding batch", "err", rejected)
+		return true
+	}
+	return false
+}
+
+// ListSpool returns the spooled batch files, oldest first.
+func ListSpool(cfg Config) ([]string, error) {
+	entries, err := os.ReadDir(cfg.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			files = append(files, filepath.Join(cfg.SpoolDir, e.Name()))
+		}
+	}
+	// names are zero padded unix nano timestamps
+	sort.Strings(files)
+	return files, nil
+}
+
+// WriteSpool saves the marshalled batch into the spool directory.
+// The file is written to a temp file and renamed, so a crash never leaves a half written batch behind.
+func WriteSpool(cfg Config, j []byte) error {
+	files, err := ListSpool(cfg)
+	if err != nil {
+		return err
+	}
+	if len(files) >= cfg.SpoolMaxBatches {
+		return fmt.Errorf("spool full with %d batches", len(files))
+	}
+	return WriteFileAtomic(filepath.Join(cfg.SpoolDir, fmt.Sprintf("%019d.json", time.Now().UnixNano())), j)
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it to path after it was synced,
+// so path always contains either the old or the new data.
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// DrainSpool sends all spooled batches in order and deletes them after setsuna acknowledged them.
+// Returns true if the spool is empty afterwards.
+func DrainSpool(logger *slog.Logger, cfg Config) bool {
+	if cfg.SpoolDir == "" {
+		return true
+	}
+	files, err := ListSpool(cfg)
+	if err != nil {
+		logger.Error("error reading spool dir", "err", err)
+		return false
+	}
+	for _, file := range files {
+		j, err := os.ReadFile(file)
+		if err != nil {
+			logger.Error("error reading spooled batch", "file", file, "err", err)
+			return false
+		}
+		if err = PostBatch(j, cfg); err != nil && !IsRejected(logger, err) {
+			logger.Debug("setsuna still unreachable, keeping spool", "spooled", len(files), "err", err)
+			return false
+		}
+		logger.Info("sent spooled batch", "file", file, "bytes", len(j))
+		if err = os.Remove(file); err != nil {
+			logger.Error("error removing spooled batch", "file", file, "err", err)
+			return false
 		}
 	}
+	return true
 }
 
-func Logging(logger *slog.Logger, logCh <-chan Log, flushCh <-chan bool, cfg Config) {
+// Logging collects the logs into batches and sends them. Once stopCh is closed the queued logs are sent and it returns.
+func Logging(logger *slog.Logger, logCh <-chan Log, flushCh <-chan bool, stopCh <-chan struct{}, cfg Config) {
 	logs := make([]Log, 0, cfg.MaxBatch)
+	send := func() {
+		Sending(logger, logs, cfg)
+		AckFiles(logs)
+		AckJournals(logs)
+		SaveProgress(logger, cfg)
+		logs = make([]Log, 0, cfg.MaxBatch)
+	}
 	for {
 		select {
 		case log := <-logCh:
 			logs = append(logs, log)
 			if len(logs) >= cfg.MaxBatch {
-				Sending(logger, logs, cfg.Target)
-				SaveProgress(logger, cfg)
-				logs = make([]Log, 0, cfg.MaxBatch)
+				send()
 			}
 		case <-flushCh:
 			if len(logs) > 0 {
 				logger.Debug("flushing fr after flushCh", "len", len(logs))
-				Sending(logger, logs, cfg.Target)
-				SaveProgress(logger, cfg)
-				logs = make([]Log, 0, cfg.MaxBatch)
+				send()
+			} else {
+				DrainSpool(logger, cfg)
+			}
+		case <-stopCh:
+			for len(logCh) > 0 {
+				logs = append(logs, <-logCh)
+				if len(logs) >= cfg.MaxBatch {
+					send()
+				}
+			}
+			if len(logs) > 0 {
+				logger.Info("sending queued logs before exiting", "len", len(logs))
+				send()
 			}
+			return
 		}
 	}
 }
@@ -116,36 +424,154 @@ func Flushing(flushCh chan<- bool, sleepTime int) {
 	}
 }
 
+// Progress is saved in the ProgressFile, Files are the offsets of tailed files (keyed by FileKey) and Journals the cursors of journald inputs.
+type Progress struct {
+	Files    map[string]FileProgress `json:"files"`
+	Journals map[string]string       `json:"journals"`
+}
+
+// FileProgress is the offset of a file. The fingerprint is the sha256 of the first FingerprintSize bytes of the file,
+// it is used to detect that an inode was reused by another file. Done is set once a compressed file was read completely.
+type FileProgress struct {
+	Path            string `json:"path"`
+	Offset          int64  `json:"offset"`
+	Fingerprint     string `json:"fingerprint,omitempty"`
+	FingerprintSize int64  `json:"fingerprint_size,omitempty"`
+	Done            bool   `json:"done,omitempty"`
+}
+
+// fingerprintBytes is the maximum number of bytes at the head of a file used for its fingerprint.
+const fingerprintBytes = 1024
+
+// ReadProgress reads the ProgressFile, an empty progress is returned if it does not exist.
+// Progress files of older versions (filename to offset maps) are still read, their files are looked up by path.
+func ReadProgress(logger *slog.Logger, cfg Config) Progress {
+	prog := Progress{}
+	if _, err := os.Stat(cfg.ProgressFile); err != nil {
+		return Progress{Files: map[string]FileProgress{}, Journals: map[string]string{}}
+	}
+	logger.Info("progress file found, using it")
+	pg, err := os.ReadFile(cfg.ProgressFile)
+	if err != nil {
+		panic(err)
+	}
+	if err = json.Unmarshal(pg, &prog); err != nil || (prog.Files == nil && prog.Journals == nil) {
+		old := struct {
+			Files    map[string]int64  `json:"files"`
+			Journals map[string]string `json:"journals"`
+		}{}
+		if err := json.Unmarshal(pg, &old); err != nil || (old.Files == nil && old.Journals == nil) {
+			old.Files = map[string]int64{}
+			if err := json.Unmarshal(pg, &old.Files); err != nil {
+				panic(err)
+			}
+		}
+		prog = Progress{Files: map[string]FileProgress{}, Journals: old.Journals}
+		for path, offset := range old.Files {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			// older versions only saved the offset of a compressed file after reading it completely
+			prog.Files[FileKey(path, info)] = FileProgress{Path: path, Offset: offset, Done: strings.HasSuffix(path, ".gz") && offset > 0}
+		}
+	}
+	if prog.Files == nil {
+		prog.Files = map[string]FileProgress{}
+	}
+	if prog.Journals == nil {
+		prog.Journals = map[string]string{}
+	}
+	return prog
+}
+
+// SaveProgress atomically writes the progress of all files and journals to the ProgressFile.
 func SaveProgress(logger *slog.Logger, cfg Config) {
-	prog := map[string]int64{}
-	var err error
-	var offset int64
+	prog := Progress{Files: map[string]FileProgress{}, Journals: map[string]string{}}
 	tailsMutex.Lock()
-	for _, t := range tails {
-		offset, err = t.Tell()
-		if err != nil {
-			logger.Error("error during tail.Tell()", "err", err)
-			tailsMutex.Unlock()
-			return
-		}
-		prog[t.Filename] = offset
+	fileProgressMutex.Lock()
+	maps.Copy(prog.Files, fileProgress)
+	fileProgressMutex.Unlock()
+	for key, t := range tails {
+		prog.Files[key] = t.Progress()
 	}
 	tailsMutex.Unlock()
+	journalsMutex.Lock()
+	maps.Copy(prog.Journals, journals)
+	journalsMutex.Unlock()
 	j, err := json.Marshal(prog)
 	if err != nil {
 		logger.Error("error during marshal", "err", err)
 		return
 	}
-	err = os.WriteFile(cfg.ProgressFile, j, 0700)
+	err = WriteFileAtomic(cfg.ProgressFile, j)
 	if err != nil {
 		logger.Error("error writing progress file", "err", err)
 	}
 }
 
-var tails map[string]*tail.Tail
+// FileKey identifies a file by its device and inode, so it is found again after it was renamed.
+func FileKey(path string, info os.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", uint64(st.Dev), uint64(st.Ino))
+	}
+	return "path:" + path
+}
+
+// Fingerprint returns the sha256 of the first fingerprintBytes of the file and how many bytes were used.
+func Fingerprint(f *os.File) (string, int64, error) {
+	buf := make([]byte, fingerprintBytes)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	sum := sha256.Sum256(buf[:n])
+	return hex.EncodeToString(sum[:]), int64(n), nil
+}
+
+// ResumeOffset returns the offset to resume reading path from.
+// It returns 0 with an error describing why, if the file is smaller than the offset (truncated) or its head
+// does not match the fingerprint (the inode was reused by another file).
+func ResumeOffset(path string, prog FileProgress) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if prog.Offset > info.Size() && !strings.HasSuffix(path, ".gz") {
+		return 0, fmt.Errorf("file was truncated, offset %d is after its size %d", prog.Offset, info.Size())
+	}
+	if prog.FingerprintSize > 0 {
+		fp, n, err := Fingerprint(f)
+		if err != nil {
+			return 0, err
+		}
+		if n < prog.FingerprintSize {
+			return 0, fmt.Errorf("file is smaller than its fingerprint")
+		}
+		if n > prog.FingerprintSize {
+			buf := make([]byte, prog.FingerprintSize)
+			if _, err := f.ReadAt(buf, 0); err != nil {
+				return 0, err
+			}
+			sum := sha256.Sum256(buf)
+			fp = hex.EncodeToString(sum[:])
+		}
+		if fp != prog.Fingerprint {
+			return 0, fmt.Errorf("fingerprint changed, the file was replaced")
+		}
+	}
+	return prog.Offset, nil
+}
+
+var tails map[string]*FileTail
 
 func main() {
-	tails = map[string]*tail.Tail{}
+	tails = map[string]*FileTail{}
 	// Config
 	CONFIGLOCATION := os.Getenv("CONFIG")
 	if CONFIGLOCATION == "" {
@@ -161,6 +587,38 @@ func main() {
 		panic(err)
 	}
 
+	if cfg.RetryMaxDelay < 1 {
+		cfg.RetryMaxDelay = 60
+	}
+	if cfg.RotateWait < 1 {
+		cfg.RotateWait = 5
+	}
+	if cfg.TokenHeader == "" {
+		cfg.TokenHeader = "Authorization"
+	}
+	if cfg.SpoolMaxBatches < 1 {
+		cfg.SpoolMaxBatches = 100
+	}
+	httpClient = CreateHTTPClient(cfg)
+	if cfg.Kubernetes.Enrich {
+		kubeClient = CreateKubeClient(cfg.Kubernetes)
+	}
+	switch cfg.Compression {
+	case "", "gzip":
+	case "zstd":
+		zstdEncoder, err = zstd.NewWriter(nil)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic("invalid Compression " + cfg.Compression + ", must be gzip, zstd or empty")
+	}
+	if cfg.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0700); err != nil {
+			panic(err)
+		}
+	}
+
 	// Logger
 	loglvl := new(slog.LevelVar)
 	if cfg.Debug {
@@ -173,18 +631,36 @@ func main() {
 
 	logger.Info("starting up", "target", cfg.Target, "files", cfg.Input, "maxbatch", cfg.MaxBatch, "maxdelay", cfg.MaxDelay)
 
+	// compile every transformer and multiline pattern once, so errors in them panic on startup and not in a tailing goroutine
+	for _, input := range cfg.Input {
+		CreateTransformer(cfg, input, logger)
+		if input.Multiline != nil {
+			if _, err := NewMultilineAggregator(*input.Multiline); err != nil {
+				panic(fmt.Sprintf("invalid multiline config of input %q: %v", input.Group, err))
+			}
+		}
+	}
+
 	LoopInputAndTailFiles(cfg, logger, logCh, true)
+	StartInputs(cfg, logger, logCh)
 	// Load new files as they come in
 	go func() {
 		for {
 			time.Sleep(time.Duration(cfg.ScanFrequency) * time.Second)
-			logger.Debug("Cleanup and load new files")
-			CleanupAndCloseFiles(cfg, logger)
+			logger.Debug("Load new files")
 			LoopInputAndTailFiles(cfg, logger, logCh, false)
 		}
 	}()
 
-	go Logging(logger, logCh, flushCh, cfg)
+	if cfg.MetricsAddr != "" {
+		go ServeMetrics(logger, cfg.MetricsAddr)
+	}
+	stopCh := make(chan struct{})
+	loggingDone := make(chan struct{})
+	go func() {
+		Logging(logger, logCh, flushCh, stopCh, cfg)
+		close(loggingDone)
+	}()
 	go Flushing(flushCh, cfg.MaxDelay)
 
 	// Wait for signal to exit
@@ -200,40 +676,43 @@ func main() {
 	}()
 
 	<-idleConnsClosed
+	close(stopCh)
+	// only acknowledged logs are in the progress file, everything that is not sent in time is read again after a restart
+	select {
+	case <-loggingDone:
+	case <-time.After(30 * time.Second):
+		logger.Warn("queued logs were not sent in time")
+	}
 	logger.Info("Exiting")
 }
 
-func CleanupAndCloseFiles(cfg Config, logger *slog.Logger) {
-	tailsMutex.Lock()
-	for file, tail := range tails {
-		if _, err := os.Stat(file); err != nil {
-			logger.Debug("Removing tail", "file", file, "err", err)
-			tail.Stop()
-			tail.Cleanup()
-			delete(tails, file)
+// IsExcluded returns true if the file or its name matches one of the Exclude globs of the input.
+func IsExcluded(input Input, file string) bool {
+	for _, pattern := range input.Exclude {
+		if ok, _ := filepath.Match(pattern, file); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(file)); ok {
+			return true
 		}
 	}
-	tailsMutex.Unlock()
+	return false
 }
 
 func LoopInputAndTailFiles(cfg Config, logger *slog.Logger, logCh chan<- Log, useProgFile bool) {
 	//Parse progress.json
-	prog := map[string]int64{}
 	if useProgFile {
-		if _, err := os.Stat(cfg.ProgressFile); err == nil {
-			logger.Info("progress file found, using it")
-			pg, err := os.ReadFile(cfg.ProgressFile)
-			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(pg, &prog)
-			if err != nil {
-				panic(err)
-			}
-		}
+		prog := ReadProgress(logger, cfg).Files
+		fileProgressMutex.Lock()
+		maps.Copy(fileProgress, prog)
+		fileProgressMutex.Unlock()
 	}
 
+	seen := map[string]bool{}
 	for _, input := range cfg.Input {
+		if !IsFileInput(input) {
+			continue
+		}
 		files, err := filepath.Glob(input.Pattern)
 		if err != nil {
 			panic(err)
@@ -244,137 +723,1417 @@ func LoopInputAndTailFiles(cfg Config, logger *slog.Logger, logCh chan<- Log, us
 		}
 		logger.Debug("Tailing files matched by pattern", "pattern", input.Pattern)
 		for _, file := range files {
-			if _, ok := GetTailFromFilePath(file); ok {
+			if IsExcluded(input, file) {
 				continue
 			}
-			logger.Debug("Tailing new file", "path", file)
-			go func() {
-				tconf := tail.Config{Follow: true, ReOpen: true}
-				if val, ok := prog[file]; ok {
-					logger.Debug("Found progress on file", "file", file, "prog", val)
-					tconf.Location = &tail.SeekInfo{Offset: val}
-				}
-				t, err := tail.TailFile(file, tconf)
+			compressed := strings.HasSuffix(file, ".gz")
+			if compressed && !input.ReadCompressed {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			key := FileKey(file, info)
+			seen[key] = true
+			if _, ok := GetTail(key); ok {
+				continue
+			}
+			var offset int64
+			if prog, ok := GetFileProgress(key); ok {
+				logger.Debug("Found progress on file", "file", file, "prog", prog)
+				offset, err = ResumeOffset(file, prog)
 				if err != nil {
-					logger.Error("error tailing file", "err", err)
-					return
+					logger.Warn("not resuming file at its progress, reading from the start", "file", file, "offset", prog.Offset, "err", err)
+				} else if compressed && prog.Done {
+					// compressed files are read once
+					continue
 				}
-				SetTail(file, t)
-
-				if input.Type == "container" {
+			}
+			logger.Debug("Tailing new file", "path", file, "offset", offset)
+			t, err := TailFile(file, offset, time.Duration(cfg.RotateWait)*time.Second)
+			if err != nil {
+				logger.Error("error tailing file", "err", err)
+				continue
+			}
+			SetTail(key, t)
+			go func() {
+				switch input.Type {
+				case "container":
 					TailFileContainer(logger, t, cfg, input, logCh)
-				} else {
-					TailFileDefault(t, cfg, input, logCh)
+				case "docker":
+					TailFileDocker(logger, t, cfg, input, logCh)
+				default:
+					TailFileDefault(logger, t, cfg, input, logCh)
 				}
-
+				if t.Err != nil {
+					logger.Error("error reading file", "file", file, "err", t.Err)
+				}
+				logger.Debug("Finished reading file", "file", file)
+				RemoveTail(key, t)
 			}()
 		}
 	}
+
+	// finish the tails of files that are not matched anymore (deleted, renamed away or excluded)
+	tailsMutex.Lock()
+	for key, t := range tails {
+		if !seen[key] {
+			t.Stop()
+		}
+	}
+	tailsMutex.Unlock()
+
+	// forget the progress of files that are gone (or not matched anymore)
+	fileProgressMutex.Lock()
+	for key := range fileProgress {
+		if !seen[key] {
+			delete(fileProgress, key)
+		}
+	}
+	fileProgressMutex.Unlock()
+}
+
+// CreateContainerTransformer creates the transformer for a container log file, which adds the kubernetes metadata to every log.
+func CreateContainerTransformer(logger *slog.Logger, file string, cfg Config, input Input) Transformer {
+	transformer := CreateTransformer(cfg, input, logger)
+	if k8s, ok := ParseContainerFilename(file); ok {
+		transformer.Extra = map[string]any{"kubernetes": k8s}
+	}
+	return transformer
+}
+
+// EnrichContainerMetadata sets the pod labels and annotations on the kubernetes metadata of a container transformer.
+// It is called for every line, the lookup goes through the cache of kubeClient so changed labels show up after CacheTTL.
+func EnrichContainerMetadata(logger *slog.Logger, file string, cfg Config, transformer *Transformer) {
+	k8s, ok := transformer.Extra["kubernetes"].(map[string]any)
+	if !ok || !cfg.Kubernetes.Enrich {
+		return
+	}
+	podMeta, err := kubeClient.GetPodMetadata(k8s["namespace"].(string), k8s["pod"].(string))
+	if err != nil {
+		logger.Warn("error getting pod metadata from kubernetes", "file", file, "err", err)
+		return
+	}
+	k8s["labels"] = podMeta.Labels
+	k8s["annotations"] = podMeta.Annotations
 }
 
-func TailFileContainer(logger *slog.Logger, t *tail.Tail, cfg Config, input Input, logCh chan<- Log) {
-	transformer := CreateTransformer(cfg)
+// IsFileInput returns true for inputs that tail the files matched by Pattern.
+func IsFileInput(input Input) bool {
+	switch input.Type {
+	case "", "default", "container", "docker":
+		return true
+	}
+	return false
+}
+
+// TailFileContainer reads CRI log files, every line is "<RFC3339Nano time> <stream> <P|F> <message>".
+// Partial (P) lines are joined until the full (F) line.
+func TailFileContainer(logger *slog.Logger, t *FileTail, cfg Config, input Input, logCh chan<- Log) {
+	transformer := CreateContainerTransformer(logger, t.Filename, cfg, input)
 	host, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
 	partial := ""
+	var partialTs time.Time
 	for line := range t.Lines {
 		//parse cri-o
-		els := strings.SplitAfterN(line.Text, " ", 4)
+		els := strings.SplitN(line.Text, " ", 4)
 		if len(els) < 4 {
 			logger.Error("invalid cri-o log line", "line", line.Text)
 			continue
 		}
+		ts, err := time.Parse(time.RFC3339Nano, els[0])
+		if err != nil {
+			logger.Warn("invalid cri-o timestamp, using read time", "ts", els[0], "err", err)
+			ts = line.Time
+		}
 		logline := els[3]
-		if els[2] == "P " {
+		if els[2] == "P" {
+			if partial == "" {
+				partialTs = ts
+			}
 			partial += els[3]
 			continue
 		}
 		if partial != "" {
-			temp := logline
-			logline = partial + temp
+			logline = partial + logline
+			ts = partialTs
 			partial = ""
 		}
 		//Create Log
-		logCh <- Log{
-			Ts:  line.Time.Format("2006-01-02 15:04:05.999"),
-			Doc: transformer.TransformSource(host, t.Filename, input.Group, logline),
-		}
+		EnrichContainerMetadata(logger, t.Filename, cfg, &transformer)
+		t.SendDocs(logCh, ts.Local(), transformer.TransformSourceWith(host, t.Filename, input.Group, logline, map[string]any{"stream": els[1]}, nil), line.Offset)
 	}
 }
 
-func TailFileDefault(t *tail.Tail, cfg Config, input Input, logCh chan<- Log) {
-	transformer := CreateTransformer(cfg)
+// DockerLine is a line of the docker json-file log driver.
+type DockerLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// TailFileDocker reads docker json-file logs. Docker splits long lines, parts without a trailing newline are joined.
+func TailFileDocker(logger *slog.Logger, t *FileTail, cfg Config, input Input, logCh chan<- Log) {
+	transformer := CreateContainerTransformer(logger, t.Filename, cfg, input)
 	host, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
+	partial := ""
+	var partialTs time.Time
 	for line := range t.Lines {
-		//Create Log
-		logCh <- Log{
-			Ts:  line.Time.Format("2006-01-02 15:04:05.999"),
-			Doc: transformer.TransformSource(host, t.Filename, input.Group, line.Text),
+		dl := DockerLine{}
+		if err := json.Unmarshal([]byte(line.Text), &dl); err != nil {
+			logger.Error("invalid docker log line", "line", line.Text, "err", err)
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, dl.Time)
+		if err != nil {
+			logger.Warn("invalid docker timestamp, using read time", "ts", dl.Time, "err", err)
+			ts = line.Time
+		}
+		if !strings.HasSuffix(dl.Log, "\n") {
+			if partial == "" {
+				partialTs = ts
+			}
+			partial += dl.Log
+			continue
+		}
+		logline := strings.TrimSuffix(dl.Log, "\n")
+		if partial != "" {
+			logline = partial + logline
+			ts = partialTs
+			partial = ""
 		}
+		EnrichContainerMetadata(logger, t.Filename, cfg, &transformer)
+		t.SendDocs(logCh, ts.Local(), transformer.TransformSourceWith(host, t.Filename, input.Group, logline, map[string]any{"stream": dl.Stream}, nil), line.Offset)
 	}
 }
 
-var tailsMutex sync.Mutex
+var containerFilename = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
 
-// func LoopThroughTails(loopFunc func(file string, tail *tail.Tail)) {}
-func GetTailFromFilePath(file string) (*tail.Tail, bool) {
-	tailsMutex.Lock()
-	tail, ok := tails[file]
-	tailsMutex.Unlock()
-	return tail, ok
+// ParseContainerFilename reads the kubernetes metadata from a /var/log/containers/<pod>_<namespace>_<container>-<id>.log filename.
+func ParseContainerFilename(file string) (map[string]any, bool) {
+	m := containerFilename.FindStringSubmatch(filepath.Base(file))
+	if m == nil {
+		return nil, false
+	}
+	return map[string]any{
+		"pod":          m[1],
+		"namespace":    m[2],
+		"container":    m[3],
+		"container_id": m[4],
+	}, true
 }
-func SetTail(file string, tail *tail.Tail) {
-	tailsMutex.Lock()
-	tails[file] = tail
-	tailsMutex.Unlock()
+
+type PodMetadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Fetched     time.Time         `json:"-"`
 }
 
-type Transformer struct {
-	VM                *goja.Runtime
-	SourceTransformer goja.Callable
+// KubeClient fetches pod metadata from the kubernetes api and caches it for CacheTTL seconds.
+type KubeClient struct {
+	APIServer string
+	Token     string
+	Client    *http.Client
+	CacheTTL  time.Duration
+	mutex     sync.Mutex
+	cache     map[string]PodMetadata
 }
 
-func CreateTransformer(cfg Config) Transformer {
-	vm := goja.New()
-	prog := goja.MustCompile("t", cfg.JSTransformer, false)
-	_, err := vm.RunProgram(prog)
+var kubeClient *KubeClient
+
+func CreateKubeClient(cfg Kubernetes) *KubeClient {
+	if cfg.APIServer == "" {
+		cfg.APIServer = "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if cfg.CAFile == "" {
+		cfg.CAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	}
+	if cfg.CacheTTL < 1 {
+		cfg.CacheTTL = 300
+	}
+	token, err := os.ReadFile(cfg.TokenFile)
 	if err != nil {
 		panic(err)
 	}
-	fn, ok := goja.AssertFunction(vm.Get("t"))
-	if !ok {
-		panic("Could not find function t")
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if pem, err := os.ReadFile(cfg.CAFile); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		tlsConfig.RootCAs = pool
 	}
-	return Transformer{
-		VM:                vm,
-		SourceTransformer: fn,
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &KubeClient{
+		APIServer: strings.TrimSuffix(cfg.APIServer, "/"),
+		Token:     strings.TrimSpace(string(token)),
+		Client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		CacheTTL:  time.Duration(cfg.CacheTTL) * time.Second,
+		cache:     map[string]PodMetadata{},
 	}
 }
 
-func (t *Transformer) TransformSource(host, file, group, line string) string {
-	j := map[string]any{}
-	if strings.HasPrefix(line, "{") {
-		if err := json.Unmarshal([]byte(line), &j); err != nil {
-			j["message"] = line
-		}
-	} else {
-		j["message"] = line
+// GetPodMetadata returns the labels and annotations of the pod, from the cache if they are not older than CacheTTL.
+// A failed request is cached as well (with the previous metadata), so it is retried after CacheTTL and not for every line.
+func (k *KubeClient) GetPodMetadata(namespace, pod string) (PodMetadata, error) {
+	key := namespace + "/" + pod
+	k.mutex.Lock()
+	meta, ok := k.cache[key]
+	k.mutex.Unlock()
+	if ok && time.Since(meta.Fetched) < k.CacheTTL {
+		return meta, nil
 	}
-	j["_meta"] = map[string]any{
-		"host":   host,
-		"file":   file,
-		"group":  group,
-		"length": len(line),
+	meta, err := k.fetchPodMetadata(namespace, pod)
+	if err != nil {
+		k.mutex.Lock()
+		stale := k.cache[key]
+		stale.Fetched = time.Now()
+		k.cache[key] = stale
+		k.mutex.Unlock()
+		return meta, err
 	}
-	res, err := t.SourceTransformer(goja.Undefined(), t.VM.ToValue(j))
+	k.mutex.Lock()
+	k.cache[key] = meta
+	k.mutex.Unlock()
+	return meta, nil
+}
+
+func (k *KubeClient) fetchPodMetadata(namespace, pod string) (PodMetadata, error) {
+	meta := PodMetadata{}
+	req, err := http.NewRequest("GET", k.APIServer+"/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(pod), nil)
+	if err != nil {
+		return meta, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.Token)
+	req.Header.Set("Accept", "application/json")
+	res, err := k.Client.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return meta, fmt.Errorf("kubernetes api returned status %d", res.StatusCode)
+	}
+	podJson := struct {
+		Metadata PodMetadata `json:"metadata"`
+	}{}
+	if err := json.UnmarshalRead(res.Body, &podJson); err != nil {
+		return meta, err
+	}
+	meta = podJson.Metadata
+	meta.Fetched = time.Now()
+	return meta, nil
+}
+
+// SendDocs sends every doc created from a line as its own log.
+func SendDocs(logCh chan<- Log, ts time.Time, docs []string) {
+	for _, doc := range docs {
+		logCh <- Log{
+			Ts:  ts.Format("2006-01-02 15:04:05.999"),
+			Doc: doc,
+		}
+	}
+}
+
+func TailFileDefault(logger *slog.Logger, t *FileTail, cfg Config, input Input, logCh chan<- Log) {
+	transformer := CreateTransformer(cfg, input, logger)
+	host, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
-	jsonbytes, err := json.Marshal(res.Export())
-	return string(jsonbytes)
+	var ml *MultilineAggregator
+	if input.Multiline != nil {
+		// the multiline configs are checked on startup, so this only fails if that check is missing
+		if ml, err = NewMultilineAggregator(*input.Multiline); err != nil {
+			logger.Error("invalid multiline config, sending lines as they are", "file", t.Filename, "err", err)
+		}
+	}
+	if ml == nil {
+		for line := range t.Lines {
+			//Create Log
+			t.SendDocs(logCh, line.Time, transformer.TransformSource(host, t.Filename, input.Group, line.Text), line.Offset)
+		}
+		return
+	}
+	// the offset of an event is the one after its last line, so lines of an unfinished event are read again after a restart
+	send := func(event MultilineEvent, ok bool) {
+		if ok {
+			t.SendDocs(logCh, event.Ts, transformer.TransformSource(host, t.Filename, input.Group, event.Text), event.Offset)
+		}
+	}
+	timeout := time.Duration(ml.Config.FlushTimeout) * time.Second
+	timer := time.NewTimer(timeout)
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				send(ml.Flush())
+				return
+			}
+			send(ml.Add(line))
+			timer.Reset(timeout)
+		case <-timer.C:
+			// no new line for a while, the event is complete
+			send(ml.Flush())
+		}
+	}
+}
+
+type MultilineAggregator struct {
+	Config  Multiline
+	Pattern *regexp.Regexp
+	Lines   []string
+	Ts      time.Time
+	Offset  int64
+}
+
+// MultilineEvent is a merged event, Offset is the offset after its last line in the file.
+type MultilineEvent struct {
+	Ts     time.Time
+	Text   string
+	Offset int64
+}
+
+// NewMultilineAggregator returns an error if the config has no (or both) patterns or the pattern is invalid.
+func NewMultilineAggregator(cfg Multiline) (*MultilineAggregator, error) {
+	if cfg.MaxLines < 1 {
+		cfg.MaxLines = 500
+	}
+	if cfg.FlushTimeout < 1 {
+		cfg.FlushTimeout = 2
+	}
+	pattern := cfg.StartPattern
+	if pattern == "" {
+		pattern = cfg.ContinuationPattern
+	}
+	if pattern == "" || (cfg.StartPattern != "" && cfg.ContinuationPattern != "") {
+		return nil, errors.New("multiline needs either startpattern or continuationpattern")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &MultilineAggregator{
+		Config:  cfg,
+		Pattern: re,
+	}, nil
+}
+
+// IsContinuation returns true if the line belongs to the current event.
+func (m *MultilineAggregator) IsContinuation(line string) bool {
+	match := m.Pattern.MatchString(line) != m.Config.Negate
+	if m.Config.StartPattern != "" {
+		return !match
+	}
+	return match
+}
+
+// Add adds the line to the current event.
+// If the line starts a new event, the previous one is returned as finished.
+func (m *MultilineAggregator) Add(line *Line) (MultilineEvent, bool) {
+	if len(m.Lines) > 0 && len(m.Lines) < m.Config.MaxLines && m.IsContinuation(line.Text) {
+		m.Lines = append(m.Lines, line.Text)
+		m.Offset = line.Offset
+		return MultilineEvent{}, false
+	}
+	event, ok := m.Flush()
+	m.Lines = append(m.Lines, line.Text)
+	m.Ts = line.Time
+	m.Offset = line.Offset
+	return event, ok
+}
+
+// Flush returns the current event joined by newlines and starts a new one.
+func (m *MultilineAggregator) Flush() (MultilineEvent, bool) {
+	if len(m.Lines) == 0 {
+		return MultilineEvent{}, false
+	}
+	text := strings.Join(m.Lines, "\n")
+	m.Lines = m.Lines[:0]
+	return MultilineEvent{Ts: m.Ts, Text: text, Offset: m.Offset}, true
+}
+
+var journals = map[string]string{}
+var journalsMutex sync.Mutex
+
+// AckJournals moves the journal cursors to the last entries of an acknowledged batch.
+func AckJournals(logs []Log) {
+	journalsMutex.Lock()
+	defer journalsMutex.Unlock()
+	for _, log := range logs {
+		if log.Cursor != "" {
+			journals[log.Journal] = log.Cursor
+		}
+	}
+}
+
+// JournalKey identifies a journald input in the progress file.
+func JournalKey(input Input) string {
+	return "journald:" + input.Group + ":" + strings.Join(input.Matches, ",")
+}
+
+// StartInputs starts every input that does not tail files.
+func StartInputs(cfg Config, logger *slog.Logger, logCh chan<- Log) {
+	var prog Progress
+	for _, input := range cfg.Input {
+		switch input.Type {
+		case "journald":
+			if prog.Journals == nil {
+				prog = ReadProgress(logger, cfg)
+			}
+			cursor := prog.Journals[JournalKey(input)]
+			logger.Info("reading journal", "group", input.Group, "matches", input.Matches, "cursor", cursor)
+			go ReadJournald(logger, cfg, input, cursor, logCh)
+		case "syslog":
+			if input.Protocol == "" || input.Protocol == "udp" {
+				go ListenSyslogUDP(logger, cfg, input, logCh)
+			}
+			if input.Protocol == "" || input.Protocol == "tcp" {
+				go ListenSyslogTCP(logger, cfg, input, logCh)
+			}
+		case "http":
+			go ListenHTTP(logger, cfg, input, logCh)
+		}
+	}
+}
+
+// ReadJournald follows the journal via "journalctl -o export" and restarts journalctl if it exits.
+// Without a saved cursor it starts with new entries only.
+func ReadJournald(logger *slog.Logger, cfg Config, input Input, cursor string, logCh chan<- Log) {
+	transformer := CreateTransformer(cfg, input, logger)
+	host, err := os.Hostname()
+	if err != nil {
+		panic(err)
+	}
+	key := JournalKey(input)
+	for {
+		args := []string{"-o", "export", "--follow"}
+		if cursor != "" {
+			args = append(args, "--after-cursor="+cursor)
+		} else {
+			args = append(args, "--lines=0")
+		}
+		args = append(args, input.Matches...)
+		cmd := exec.Command("journalctl", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			logger.Error("error starting journalctl, retrying in 10s", "err", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		r := bufio.NewReader(stdout)
+		for {
+			entry, err := ReadJournalEntry(r)
+			if err != nil {
+				if err != io.EOF {
+					logger.Error("error reading journal entry", "err", err)
+				}
+				break
+			}
+			ts := time.Now()
+			if us, err := strconv.ParseInt(entry["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+				ts = time.UnixMicro(us)
+			}
+			docs := transformer.TransformSourceWith(host, "journald", input.Group, entry["MESSAGE"], nil, map[string]any{"journald": JournalFields(entry)})
+			cursor = entry["__CURSOR"]
+			// the cursor travels with the last log of the entry, dropped entries are read (and dropped) again after a restart
+			for i, doc := range docs {
+				log := Log{Ts: ts.Format("2006-01-02 15:04:05.999"), Doc: doc}
+				if i == len(docs)-1 {
+					log.Journal, log.Cursor = key, cursor
+				}
+				logCh <- log
+			}
+		}
+		stdout.Close()
+		err = cmd.Wait()
+		logger.Error("journalctl exited, restarting in 10s", "err", err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// JournalFields maps the journal fields that are added to the doc, numbers are converted to ints.
+func JournalFields(entry map[string]string) map[string]any {
+	fields := map[string]any{}
+	for field, name := range map[string]string{
+		"_SYSTEMD_UNIT":     "unit",
+		"SYSLOG_IDENTIFIER": "identifier",
+		"_COMM":             "comm",
+		"_HOSTNAME":         "hostname",
+		"_TRANSPORT":        "transport",
+		"_BOOT_ID":          "boot_id",
+	} {
+		if v, ok := entry[field]; ok {
+			fields[name] = v
+		}
+	}
+	for field, name := range map[string]string{
+		"PRIORITY": "priority",
+		"_PID":     "pid",
+		"_UID":     "uid",
+	} {
+		if v, err := strconv.Atoi(entry[field]); err == nil {
+			fields[name] = v
+		}
+	}
+	return fields
+}
+
+// ReadJournalEntry reads one entry of the journal export format.
+// Fields are "KEY=value" lines, binary fields are "KEY", a little endian uint64 length and the data. Entries end with an empty line.
+func ReadJournalEntry(r *bufio.Reader) (map[string]string, error) {
+	entry := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(entry) > 0 {
+				return entry, nil
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			entry[line[:i]] = line[i+1:]
+			continue
+		}
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		entry[line] = string(data)
+	}
+}
+
+// ListenHTTP accepts logs via POST on input.Listen. The body can be a json object, an array or newline delimited json objects.
+// Strings in the body are handled like lines of a file. If logCh is too full for the logs, 429 is returned.
+func ListenHTTP(logger *slog.Logger, cfg Config, input Input, logCh chan<- Log) {
+	transformers := sync.Pool{New: func() any {
+		t := CreateTransformer(cfg, input, logger)
+		return &t
+	}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
+		lines, err := ReadHTTPLines(http.MaxBytesReader(w, r.Body, 10<<20))
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			writeHTTPJSON(w, 413, `{"error":"body is larger than `+strconv.FormatInt(maxBytesErr.Limit, 10)+` bytes"}`)
+			return
+		}
+		if err != nil {
+			logger.Warn("invalid http input body", "remote", r.RemoteAddr, "err", err)
+			writeHTTPJSON(w, 400, `{"error":"invalid body"}`)
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		transformer := transformers.Get().(*Transformer)
+		// the docs of every item of the body, "accepted" counts items so the client knows which ones to resend
+		items := make([][]string, len(lines))
+		docs := 0
+		for i, line := range lines {
+			items[i] = transformer.TransformSource(host, "http", input.Group, line)
+			docs += len(items[i])
+		}
+		transformers.Put(transformer)
+		if docs > cap(logCh) {
+			writeHTTPJSON(w, 413, `{"error":"body has more logs than fit into the queue (`+strconv.Itoa(cap(logCh))+`)"}`)
+			return
+		}
+		// the other inputs fill the queue as well, so the handler doesn't wait for space and answers with what was queued
+		ts := time.Now().Format("2006-01-02 15:04:05.999")
+		for i, item := range items {
+			if !queueHTTPItem(logCh, ts, item) {
+				logger.Warn("queue full, http logs partially accepted", "remote", r.RemoteAddr, "accepted", i, "items", len(items))
+				w.Header().Set("Retry-After", "1")
+				writeHTTPJSON(w, 429, `{"error":"too many logs queued, retry later","accepted":`+strconv.Itoa(i)+`}`)
+				return
+			}
+		}
+		writeHTTPJSON(w, 200, `{"accepted":`+strconv.Itoa(len(items))+`}`)
+	})
+	srv := &http.Server{
+		Addr:         input.Listen,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	logger.Info("listening for http logs", "addr", input.Listen, "group", input.Group)
+	if err := srv.ListenAndServe(); err != nil {
+		panic(err)
+	}
+}
+
+// queueHTTPItem queues the docs of one item of an http body without waiting and returns false if the queue is full.
+// An item is only started if all its docs fit, if the other inputs fill the queue in between its queued docs are sent again when the client resends it.
+func queueHTTPItem(logCh chan<- Log, ts string, docs []string) bool {
+	if cap(logCh)-len(logCh) < len(docs) {
+		return false
+	}
+	for _, doc := range docs {
+		select {
+		case logCh <- Log{Ts: ts, Doc: doc}:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writeHTTPJSON writes a json body, http.Error would send it as text/plain.
+func writeHTTPJSON(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+// ReadHTTPLines splits the body into the lines passed to the transformer, objects as raw json and strings unquoted.
+func ReadHTTPLines(body io.Reader) ([]string, error) {
+	dec := jsontext.NewDecoder(body)
+	array := dec.PeekKind() == '['
+	if array {
+		if _, err := dec.ReadToken(); err != nil {
+			return nil, err
+		}
+	}
+	lines := []string{}
+	for {
+		if array && dec.PeekKind() == ']' {
+			_, err := dec.ReadToken()
+			return lines, err
+		}
+		val, err := dec.ReadValue()
+		if err == io.EOF && !array {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch val.Kind() {
+		case '{':
+			lines = append(lines, string(val))
+		case '"':
+			var line string
+			if err := json.Unmarshal(val, &line); err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		default:
+			return nil, fmt.Errorf("invalid value %s, must be object or string", val.Kind())
+		}
+	}
+}
+
+const maxSyslogMessage = 1 << 20
+
+// ListenSyslogUDP receives syslog messages, one per datagram.
+func ListenSyslogUDP(logger *slog.Logger, cfg Config, input Input, logCh chan<- Log) {
+	conn, err := net.ListenPacket("udp", input.Listen)
+	if err != nil {
+		panic(err)
+	}
+	logger.Info("listening for syslog", "addr", input.Listen, "protocol", "udp", "group", input.Group)
+	transformer := CreateTransformer(cfg, input, logger)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Error("error reading syslog udp packet", "err", err)
+			continue
+		}
+		SendSyslog(&transformer, input, addr.String(), string(buf[:n]), logCh)
+	}
+}
+
+// ListenSyslogTCP receives syslog messages, framed by newlines or octet counting (RFC6587).
+func ListenSyslogTCP(logger *slog.Logger, cfg Config, input Input, logCh chan<- Log) {
+	ln, err := net.Listen("tcp", input.Listen)
+	if err != nil {
+		panic(err)
+	}
+	logger.Info("listening for syslog", "addr", input.Listen, "protocol", "tcp", "group", input.Group)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("error accepting syslog connection", "err", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			transformer := CreateTransformer(cfg, input, logger)
+			r := bufio.NewReader(conn)
+			for {
+				msg, err := ReadSyslogFrame(r)
+				if err != nil {
+					if err != io.EOF {
+						logger.Error("error reading syslog message, closing connection", "remote", conn.RemoteAddr(), "err", err)
+					}
+					return
+				}
+				SendSyslog(&transformer, input, conn.RemoteAddr().String(), msg, logCh)
+			}
+		}()
+	}
+}
+
+// ReadSyslogFrame reads one message, octet counted ("<len> <msg>") if it starts with a digit, else up to the next newline.
+func ReadSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		l, err := r.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(l, " "))
+		if err != nil || size > maxSyslogMessage {
+			return "", fmt.Errorf("invalid octet count %q", l)
+		}
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		return string(msg), err
+	}
+	var msg []byte
+	for {
+		part, err := r.ReadSlice('\n')
+		msg = append(msg, part...)
+		if len(msg) > maxSyslogMessage {
+			return "", errors.New("syslog message too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(msg) == 0) {
+			return "", err
+		}
+		return strings.TrimRight(string(msg), "\r\n"), nil
+	}
+}
+
+func SendSyslog(transformer *Transformer, input Input, remote, msg string, logCh chan<- Log) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	if msg == "" {
+		return
+	}
+	ts, message, fields := ParseSyslog(msg, time.Now())
+	host, _, _ := net.SplitHostPort(remote)
+	SendDocs(logCh, ts, transformer.TransformSourceWith(host, "syslog", input.Group, message, nil, map[string]any{"syslog": fields}))
+}
+
+// ParseSyslog parses a RFC5424 or RFC3164 message and returns its timestamp (now if it has none), the message and the syslog fields.
+// Messages that can not be parsed are returned as they are.
+func ParseSyslog(msg string, now time.Time) (time.Time, string, map[string]any) {
+	fields := map[string]any{}
+	if !strings.HasPrefix(msg, "<") {
+		return now, msg, fields
+	}
+	end := strings.IndexByte(msg, '>')
+	pri, err := strconv.Atoi(msg[1:max(end, 1)])
+	if end < 2 || end > 4 || err != nil || pri > 191 {
+		return now, msg, fields
+	}
+	fields["facility"] = pri / 8
+	fields["severity"] = pri % 8
+	rest := msg[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return parseSyslog5424(rest[2:], now, fields)
+	}
+	return parseSyslog3164(rest, now, fields)
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG, "-" is an empty value
+func parseSyslog5424(rest string, now time.Time, fields map[string]any) (time.Time, string, map[string]any) {
+	fields["version"] = 1
+	ts := now
+	parts := strings.SplitN(rest, " ", 6)
+	if len(parts) < 6 {
+		return now, rest, fields
+	}
+	if parts[0] != "-" {
+		if t, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+			ts = t
+		}
+	}
+	for i, name := range []string{"", "hostname", "appname", "procid", "msgid"} {
+		if i > 0 && parts[i] != "-" {
+			fields[name] = parts[i]
+		}
+	}
+	sd, message := parseStructuredData(parts[5])
+	if len(sd) > 0 {
+		fields["structured_data"] = sd
+	}
+	return ts, strings.TrimPrefix(message, "\uFEFF"), fields
+}
+
+// Parses "-" or "[id key="value" ...][id2 ...]" and returns the rest of the string (the message).
+func parseStructuredData(s string) (map[string]any, string) {
+	sd := map[string]any{}
+	if strings.HasPrefix(s, "-") {
+		return sd, strings.TrimPrefix(s[1:], " ")
+	}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		i := strings.IndexAny(s, " ]")
+		if i < 0 {
+			return sd, s
+		}
+		params := map[string]any{}
+		sd[s[:i]] = params
+		s = s[i:]
+		for strings.HasPrefix(s, " ") {
+			s = strings.TrimLeft(s, " ")
+			eq := strings.Index(s, "=\"")
+			if eq < 0 {
+				return sd, s
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var val strings.Builder
+			for len(s) > 0 && s[0] != '"' {
+				if s[0] == '\\' && len(s) > 1 && (s[1] == '"' || s[1] == '\\' || s[1] == ']') {
+					s = s[1:]
+				}
+				val.WriteByte(s[0])
+				s = s[1:]
+			}
+			params[name] = val.String()
+			if len(s) > 0 {
+				s = s[1:]
+			}
+		}
+		s = strings.TrimPrefix(s, "]")
+	}
+	return sd, strings.TrimPrefix(s, " ")
+}
+
+var syslog3164Tag = regexp.MustCompile(`^([^\s:\[]+)(?:\[([^\]]*)\])?: ?`)
+
+// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG, the year is guessed from now
+func parseSyslog3164(rest string, now time.Time, fields map[string]any) (time.Time, string, map[string]any) {
+	ts := now
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, rest[:15], now.Location()); err == nil {
+			ts = t.AddDate(now.Year(), 0, 0)
+			// logs from december received in january
+			if ts.After(now.AddDate(0, 0, 1)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			rest = rest[16:]
+			if i := strings.IndexByte(rest, ' '); i > 0 {
+				fields["hostname"] = rest[:i]
+				rest = rest[i+1:]
+			}
+		}
+	}
+	if m := syslog3164Tag.FindStringSubmatch(rest); m != nil {
+		fields["appname"] = m[1]
+		if m[2] != "" {
+			fields["procid"] = m[2]
+		}
+		rest = rest[len(m[0]):]
+	}
+	return ts, rest, fields
+}
+
+var tailsMutex sync.Mutex
+
+// fileProgress is the progress of files that are not tailed right now, e.g. rotated files that were read to their end.
+// It is keyed by FileKey like tails.
+var fileProgress = map[string]FileProgress{}
+var fileProgressMutex sync.Mutex
+
+// func LoopThroughTails(loopFunc func(key string, tail *FileTail)) {}
+func GetTail(key string) (*FileTail, bool) {
+	tailsMutex.Lock()
+	tail, ok := tails[key]
+	tailsMutex.Unlock()
+	return tail, ok
+}
+func SetTail(key string, tail *FileTail) {
+	tailsMutex.Lock()
+	tails[key] = tail
+	tailsMutex.Unlock()
+}
+
+// RemoveTail removes the finished tail and keeps its progress, so the file is not read again if it is still matched
+// under another name. If logs of the tail are not acknowledged yet, it is kept until AckFiles acknowledged them.
+func RemoveTail(key string, tail *FileTail) {
+	tailsMutex.Lock()
+	defer tailsMutex.Unlock()
+	tail.finished = true
+	if tail.pending.Load() == 0 {
+		removeTail(key, tail)
+	}
+}
+
+// removeTail has to be called with tailsMutex locked.
+func removeTail(key string, tail *FileTail) {
+	if tails[key] == tail {
+		delete(tails, key)
+		fileProgressMutex.Lock()
+		fileProgress[key] = tail.Progress()
+		fileProgressMutex.Unlock()
+	}
+}
+
+// AckFiles moves the progress of the files to the last lines of an acknowledged batch.
+func AckFiles(logs []Log) {
+	tailsMutex.Lock()
+	defer tailsMutex.Unlock()
+	for _, log := range logs {
+		if log.File == "" {
+			continue
+		}
+		t, ok := tails[log.File]
+		if !ok {
+			continue
+		}
+		t.acked.Store(log.Offset)
+		if t.pending.Add(-1) == 0 && t.finished {
+			removeTail(log.File, t)
+		}
+	}
+}
+
+func GetFileProgress(key string) (FileProgress, bool) {
+	fileProgressMutex.Lock()
+	prog, ok := fileProgress[key]
+	fileProgressMutex.Unlock()
+	return prog, ok
+}
+
+// Line is a line of a file, Offset is the offset after it.
+type Line struct {
+	Text   string
+	Time   time.Time
+	Offset int64
+}
+
+// FileTail follows a file by its open handle and not by its name.
+// If the file is rotated (the path points to another inode or is gone) or Stop is called, the old file is read for
+// RotateWait more before the tail finishes, so lines written between the last read and the rotation are not lost.
+// Compressed (.gz) files are read once from the start.
+// The progress of a tail only covers lines whose logs were acknowledged (see SendDocs and AckFiles).
+type FileTail struct {
+	Filename   string
+	Key        string
+	Lines      chan *Line
+	Err        error
+	file       *os.File
+	info       os.FileInfo
+	offset     atomic.Int64
+	compressed bool
+	done       atomic.Bool
+	// acked is the offset after the last acknowledged line, pending the number of lines with unacknowledged logs
+	acked    atomic.Int64
+	pending  atomic.Int64
+	finished bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	// fingerprint of the head of the file, recomputed while the file is smaller than fingerprintBytes
+	fpMutex sync.Mutex
+	fp      string
+	fpSize  int64
+}
+
+// TailFile opens the file and starts reading it from offset.
+func TailFile(filename string, offset int64, rotateWait time.Duration) (*FileTail, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &FileTail{
+		Filename:   filename,
+		Key:        FileKey(filename, info),
+		Lines:      make(chan *Line),
+		file:       file,
+		info:       info,
+		compressed: strings.HasSuffix(filename, ".gz"),
+		stop:       make(chan struct{}),
+	}
+	t.updateFingerprint()
+	if !t.compressed && offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		t.offset.Store(offset)
+		t.acked.Store(offset)
+	}
+	go t.run(rotateWait)
+	return t, nil
+}
+
+// Tell returns the offset after the last line that was sent to Lines.
+// For compressed files it is 0 until the file was read completely, then it is the size of the file.
+func (t *FileTail) Tell() (int64, error) {
+	return t.offset.Load(), nil
+}
+
+// Progress returns the offset after the last acknowledged line and the fingerprint of the file.
+// Once the tail finished and every log was acknowledged, it is the offset after the last read line (lines in between
+// produced no logs). Has to be called with tailsMutex locked.
+func (t *FileTail) Progress() FileProgress {
+	offset, done := t.acked.Load(), false
+	if t.finished && t.pending.Load() == 0 {
+		offset, _ = t.Tell()
+		done = t.done.Load()
+	}
+	t.fpMutex.Lock()
+	defer t.fpMutex.Unlock()
+	return FileProgress{Path: t.Filename, Offset: offset, Fingerprint: t.fp, FingerprintSize: t.fpSize, Done: done}
+}
+
+// SendDocs sends the docs created from the lines up to offset, the last log carries the offset so it is saved
+// once its batch is acknowledged.
+func (t *FileTail) SendDocs(logCh chan<- Log, ts time.Time, docs []string, offset int64) {
+	if len(docs) == 0 {
+		return
+	}
+	t.pending.Add(1)
+	for i, doc := range docs {
+		log := Log{Ts: ts.Format("2006-01-02 15:04:05.999"), Doc: doc}
+		if i == len(docs)-1 {
+			log.File, log.Offset = t.Key, offset
+		}
+		logCh <- log
+	}
+}
+
+func (t *FileTail) updateFingerprint() {
+	t.fpMutex.Lock()
+	defer t.fpMutex.Unlock()
+	if t.fpSize >= fingerprintBytes {
+		return
+	}
+	if fp, n, err := Fingerprint(t.file); err == nil {
+		t.fp, t.fpSize = fp, n
+	}
+}
+
+// Stop finishes the tail like a rotated file, it keeps reading for RotateWait and then closes the file.
+func (t *FileTail) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func (t *FileTail) run(rotateWait time.Duration) {
+	defer close(t.Lines)
+	defer t.file.Close()
+	var r *bufio.Reader
+	if t.compressed {
+		gz, err := gzip.NewReader(t.file)
+		if err != nil {
+			t.Err = err
+			return
+		}
+		r = bufio.NewReader(gz)
+	} else {
+		r = bufio.NewReader(t.file)
+	}
+	partial := ""
+	var rotatedAt time.Time
+	stop := t.stop
+	for {
+		s, err := r.ReadString('\n')
+		if err == nil {
+			t.send(partial + s)
+			partial = ""
+			continue
+		}
+		partial += s
+		if err != io.EOF {
+			t.Err = err
+			return
+		}
+		if t.compressed {
+			if partial != "" {
+				t.send(partial)
+			}
+			t.offset.Store(t.info.Size())
+			t.done.Store(true)
+			return
+		}
+		t.updateFingerprint()
+		select {
+		case <-stop:
+			stop = nil
+			if rotatedAt.IsZero() {
+				rotatedAt = time.Now()
+			}
+		case <-time.After(250 * time.Millisecond):
+		}
+		if info, err := t.file.Stat(); err == nil && info.Size() < t.offset.Load()+int64(len(partial)) {
+			// truncated (e.g. copytruncate), start from the beginning again
+			if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+				t.Err = err
+				return
+			}
+			r.Reset(t.file)
+			t.offset.Store(0)
+			t.fpMutex.Lock()
+			t.fpSize = 0
+			t.fpMutex.Unlock()
+			t.updateFingerprint()
+			partial = ""
+			continue
+		}
+		if rotatedAt.IsZero() {
+			if info, err := os.Stat(t.Filename); err != nil || !os.SameFile(info, t.info) {
+				rotatedAt = time.Now()
+			}
+		} else if time.Since(rotatedAt) > rotateWait {
+			if partial != "" {
+				t.send(partial)
+			}
+			return
+		}
+	}
+}
+
+// send moves the offset past the line and sends it to Lines.
+func (t *FileTail) send(text string) {
+	offset := t.offset.Load()
+	if !t.compressed {
+		offset = t.offset.Add(int64(len(text)))
+	}
+	t.Lines <- &Line{Text: strings.TrimRight(text, "\r\n"), Time: time.Now(), Offset: offset}
+}
+
+var TransformerEmitted, TransformerDropped, TransformerErrors atomic.Uint64
+
+// ServeMetrics serves the transformer counters in the prometheus format on addr.
+func ServeMetrics(logger *slog.Logger, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "# TYPE effie_transformer_emitted_total counter\neffie_transformer_emitted_total "+strconv.FormatUint(TransformerEmitted.Load(), 10)+
+			"\n# TYPE effie_transformer_dropped_total counter\neffie_transformer_dropped_total "+strconv.FormatUint(TransformerDropped.Load(), 10)+
+			"\n# TYPE effie_transformer_errors_total counter\neffie_transformer_errors_total "+strconv.FormatUint(TransformerErrors.Load(), 10)+"\n")
+	})
+	logger.Info("serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("error serving metrics", "err", err)
+	}
+}
+
+type Transformer struct {
+	Logger            *slog.Logger
+	VM                *goja.Runtime
+	SourceTransformer goja.Callable
+	MessageParser     goja.Callable
+	Fields            map[string]any
+	Tags              []string
+	// Extra is added to every log before the JSTransformer runs, e.g. the kubernetes metadata of a container
+	Extra map[string]any
+}
+
+// CreateTransformer compiles the JSTransformer of the input, the global one is used if the input has none.
+func CreateTransformer(cfg Config, input Input, logger *slog.Logger) Transformer {
+	script := cfg.JSTransformer
+	if input.JSTransformerFile != "" {
+		b, err := os.ReadFile(input.JSTransformerFile)
+		if err != nil {
+			panic(err)
+		}
+		script = string(b)
+	} else if input.JSTransformer != "" {
+		script = input.JSTransformer
+	}
+	vm := goja.New()
+	prog := goja.MustCompile("t", script, false)
+	_, err := vm.RunProgram(prog)
+	if err != nil {
+		panic(err)
+	}
+	fn, ok := goja.AssertFunction(vm.Get("t"))
+	if !ok {
+		panic("Could not find function t")
+	}
+	transformer := Transformer{
+		Logger:            logger,
+		VM:                vm,
+		SourceTransformer: fn,
+		Fields:            input.Fields,
+		Tags:              input.Tags,
+	}
+	if cfg.JSMessageParser != "" {
+		prog := goja.MustCompile("p", cfg.JSMessageParser, false)
+		if _, err := vm.RunProgram(prog); err != nil {
+			panic(err)
+		}
+		transformer.MessageParser, ok = goja.AssertFunction(vm.Get("p"))
+		if !ok {
+			panic("Could not find function p")
+		}
+	}
+	return transformer
+}
+
+// ParseLine turns a line into a log, json lines are parsed and every other line is put into "message".
+func ParseLine(line string) map[string]any {
+	j := map[string]any{}
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &j); err != nil {
+			j["message"] = line
+		}
+	} else {
+		j["message"] = line
+	}
+	return j
+}
+
+// ParseMessage calls the JSMessageParser with the raw line and meta.
+// It can return an object, an array of objects, a string (parsed like a normal line) or null to drop the line.
+func (t *Transformer) ParseMessage(line string, meta map[string]any) []map[string]any {
+	res, err := t.MessageParser(goja.Undefined(), t.VM.ToValue(line), t.VM.ToValue(maps.Clone(meta)))
+	if err != nil {
+		TransformerErrors.Add(1)
+		t.Logger.Error("error in JSMessageParser, skipping line", "err", err, "file", meta["file"])
+		return nil
+	}
+	var items []any
+	switch v := res.Export().(type) {
+	case nil:
+		TransformerDropped.Add(1)
+		return nil
+	case []any:
+		items = v
+	default:
+		items = []any{v}
+	}
+	logs := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case map[string]any:
+			logs = append(logs, v)
+		case string:
+			logs = append(logs, ParseLine(v))
+		case nil:
+		default:
+			TransformerErrors.Add(1)
+			t.Logger.Warn("JSMessageParser returned invalid value, must be object or string", "value", v)
+		}
+	}
+	return logs
+}
+
+// TransformSource parses the line (with the JSMessageParser if configured) and runs the transformer over every resulting log.
+// Returns the logs as json docs, zero docs if the line was dropped.
+func (t *Transformer) TransformSource(host, file, group, line string) []string {
+	return t.TransformSourceWith(host, file, group, line, nil, nil)
+}
+
+// cloneValue returns a deep copy of the maps in v, other values are returned as they are.
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = cloneValue(e)
+		}
+		return m
+	case map[string]string:
+		return maps.Clone(v)
+	}
+	return v
+}
+
+// TransformSourceWith is the same as TransformSource but adds metaFields to the _meta of every log (e.g. the stream of a container line)
+// and fields to the log itself (e.g. the syslog fields).
+func (t *Transformer) TransformSourceWith(host, file, group, line string, metaFields, fields map[string]any) []string {
+	meta := maps.Clone(t.Fields)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	if len(t.Tags) > 0 {
+		meta["tags"] = t.Tags
+	}
+	maps.Copy(meta, metaFields)
+	meta["host"] = host
+	meta["file"] = file
+	meta["group"] = group
+	meta["length"] = len(line)
+	var logs []map[string]any
+	if t.MessageParser != nil {
+		logs = t.ParseMessage(line, meta)
+	} else {
+		logs = []map[string]any{ParseLine(line)}
+	}
+	docs := make([]string, 0, len(logs))
+	for _, j := range logs {
+		for k, v := range t.Extra {
+			// cloned so the JSTransformer can't change it for the following logs (or the pod metadata cache)
+			j[k] = cloneValue(v)
+		}
+		for k, v := range fields {
+			j[k] = v
+		}
+		j["_meta"] = maps.Clone(meta)
+		docs = append(docs, t.Transform(j)...)
+	}
+	return docs
+}
+
+// Transform runs the JSTransformer over a log. It can return an object, an array of objects (multiple logs)
+// or null/undefined to drop the log. Errors in the transformer are logged and the log is skipped.
+func (t *Transformer) Transform(j map[string]any) []string {
+	res, err := t.SourceTransformer(goja.Undefined(), t.VM.ToValue(j))
+	if err != nil {
+		TransformerErrors.Add(1)
+		t.Logger.Error("error in JSTransformer, skipping log", "err", err, "meta", j["_meta"])
+		return nil
+	}
+	var items []any
+	switch v := res.Export().(type) {
+	case nil:
+		TransformerDropped.Add(1)
+		return nil
+	case []any:
+		items = v
+	default:
+		items = []any{v}
+	}
+	docs := make([]string, 0, len(items))
+	for _, item := range items {
+		if _, ok := item.(map[string]any); !ok {
+			TransformerErrors.Add(1)
+			t.Logger.Warn("JSTransformer returned invalid value, must be object", "value", item)
+			continue
+		}
+		jsonbytes, err := json.Marshal(item)
+		if err != nil {
+			TransformerErrors.Add(1)
+			t.Logger.Error("error during marshal of transformed log", "err", err)
+			continue
+		}
+		docs = append(docs, string(jsonbytes))
+	}
+	TransformerEmitted.Add(uint64(len(docs)))
+	return docs
 }
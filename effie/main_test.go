@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetPodMetadata(t *testing.T) {
+	var requests atomic.Int32
+	var app atomic.Value
+	app.Store("web")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/api/v1/namespaces/shop/pods/web-5d8f" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"kind":"Pod","metadata":{"name":"web-5d8f","namespace":"shop","labels":{"app":%q},"annotations":{"team":"checkout"}},"spec":{}}`, app.Load())
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k := CreateKubeClient(Kubernetes{APIServer: server.URL, TokenFile: tokenFile, CAFile: filepath.Join(t.TempDir(), "ca.crt"), CacheTTL: 300})
+
+	meta, err := k.GetPodMetadata("shop", "web-5d8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Labels["app"] != "web" {
+		t.Errorf("labels = %v, want app=web", meta.Labels)
+	}
+	if meta.Annotations["team"] != "checkout" {
+		t.Errorf("annotations = %v, want team=checkout", meta.Annotations)
+	}
+
+	// served from the cache
+	app.Store("shop")
+	meta, err = k.GetPodMetadata("shop", "web-5d8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Labels["app"] != "web" {
+		t.Errorf("cached labels = %v, want app=web", meta.Labels)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("api requests = %d, want 1", n)
+	}
+
+	// fetched again once the cache expired
+	k.CacheTTL = 0
+	meta, err = k.GetPodMetadata("shop", "web-5d8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Labels["app"] != "shop" {
+		t.Errorf("refreshed labels = %v, want app=shop", meta.Labels)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("api requests = %d, want 2", n)
+	}
+
+	// errors are cached too, so a missing pod isn't requested for every line
+	k.CacheTTL = time.Minute
+	if _, err := k.GetPodMetadata("shop", "gone"); err == nil {
+		t.Error("expected an error for a missing pod")
+	}
+	if _, err := k.GetPodMetadata("shop", "gone"); err != nil {
+		t.Errorf("expected the cached result, got %v", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("api requests = %d, want 3", n)
+	}
+}
+
+func TestEnrichContainerMetadata(t *testing.T) {
+	var app atomic.Value
+	app.Store("web")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"metadata":{"labels":{"app":%q},"annotations":{"team":"checkout"}}}`, app.Load())
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubeClient = CreateKubeClient(Kubernetes{APIServer: server.URL, TokenFile: tokenFile, CAFile: filepath.Join(t.TempDir(), "ca.crt")})
+	defer func() { kubeClient = nil }()
+
+	cfg := Config{JSTransformer: "function t(log) { return log; }", Kubernetes: Kubernetes{Enrich: true}}
+	file := "/var/log/containers/web-5d8f_shop_nginx-" + fmt.Sprintf("%064x", 1) + ".log"
+	transformer := CreateContainerTransformer(slog.Default(), file, cfg, Input{Type: "container"})
+	labels := func() map[string]string {
+		EnrichContainerMetadata(slog.Default(), file, cfg, &transformer)
+		return transformer.Extra["kubernetes"].(map[string]any)["labels"].(map[string]string)
+	}
+	if l := labels(); l["app"] != "web" {
+		t.Errorf("labels = %v, want app=web", l)
+	}
+
+	// the labels of an open file follow the pod once the cache expired
+	app.Store("shop")
+	kubeClient.CacheTTL = 0
+	if l := labels(); l["app"] != "shop" {
+		t.Errorf("labels = %v, want app=shop", l)
+	}
+}
+
+func TestFileProgressFollowsAcks(t *testing.T) {
+	tails = map[string]*FileTail{}
+	defer func() { tails = nil }()
+	file := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(file, []byte("one\ntwo\n{\"drop\":true}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := TailFile(file, 0, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTail(tail.Key, tail)
+	logCh := make(chan Log, 10)
+	done := make(chan struct{})
+	go func() {
+		cfg := Config{JSTransformer: "function t(log) { return log.drop ? null : log; }"}
+		TailFileDefault(slog.Default(), tail, cfg, Input{}, logCh)
+		RemoveTail(tail.Key, tail)
+		close(done)
+	}()
+	logs := []Log{<-logCh, <-logCh}
+	progress := func() FileProgress {
+		tailsMutex.Lock()
+		defer tailsMutex.Unlock()
+		if tail, ok := tails[tail.Key]; ok {
+			return tail.Progress()
+		}
+		prog, _ := GetFileProgress(tail.Key)
+		return prog
+	}
+	if p := progress(); p.Offset != 0 {
+		t.Errorf("offset before the ack = %d, want 0", p.Offset)
+	}
+	AckFiles(logs[:1])
+	if p := progress(); p.Offset != 4 {
+		t.Errorf("offset after the first ack = %d, want 4", p.Offset)
+	}
+
+	// the tail finished, but is kept until its last log is acknowledged
+	os.Remove(file)
+	<-done
+	if _, ok := GetTail(tail.Key); !ok {
+		t.Fatal("tail was removed before its logs were acknowledged")
+	}
+	if p := progress(); p.Offset != 4 {
+		t.Errorf("offset of the finished tail = %d, want 4", p.Offset)
+	}
+	AckFiles(logs[1:])
+	if _, ok := GetTail(tail.Key); ok {
+		t.Error("tail was not removed after its logs were acknowledged")
+	}
+	// the dropped last line is covered once every log was acknowledged
+	if p := progress(); p.Offset != 22 {
+		t.Errorf("offset after the last ack = %d, want 22", p.Offset)
+	}
+}
+
+func TestMultilineAggregator(t *testing.T) {
+	if _, err := NewMultilineAggregator(Multiline{StartPattern: "("}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+	if _, err := NewMultilineAggregator(Multiline{}); err == nil {
+		t.Error("expected an error without a pattern")
+	}
+	ml, err := NewMultilineAggregator(Multiline{StartPattern: `^\d`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []MultilineEvent
+	offset := int64(0)
+	for _, text := range []string{"1 error", "  at a", "  at b", "2 ok", "  at c"} {
+		offset += int64(len(text)) + 1
+		if event, ok := ml.Add(&Line{Text: text, Offset: offset}); ok {
+			events = append(events, event)
+		}
+	}
+	// the offset of an event is the one after its last line, the unfinished event is not covered
+	if len(events) != 1 || events[0].Text != "1 error\n  at a\n  at b" || events[0].Offset != 22 {
+		t.Errorf("events = %+v", events)
+	}
+	if event, ok := ml.Flush(); !ok || event.Text != "2 ok\n  at c" || event.Offset != offset {
+		t.Errorf("flushed event = %+v, want offset %d", event, offset)
+	}
+}
+
+func TestTransformKeepsPodMetadata(t *testing.T) {
+	labels := map[string]string{"app": "web", "secret": "x"}
+	cfg := Config{JSTransformer: "function t(log) { delete log.kubernetes.labels.secret; log.kubernetes.labels.app = 'shop'; return log; }"}
+	transformer := CreateTransformer(cfg, Input{}, slog.Default())
+	transformer.Extra = map[string]any{"kubernetes": map[string]any{"labels": labels}}
+	for range 2 {
+		if docs := transformer.TransformSource("host", "file", "group", "line"); len(docs) != 1 {
+			t.Fatalf("docs = %v", docs)
+		}
+	}
+	if labels["app"] != "web" || labels["secret"] != "x" {
+		t.Errorf("labels = %v, the transformer changed the cached pod metadata", labels)
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"database/sql"
-	//"encoding/json"
+	"encoding/json/jsontext"
+	"encoding/json/v2"
 	"context"
 	"fmt"
 	"github.com/httmako/jote"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"html/template"
 	"log/slog"
 	"net/http"
@@ -14,28 +15,55 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 	"os"
 	"embed"
+	"errors"
 	"github.com/ganigeorgiev/fexpr"
 	"regexp"
+	"slices"
 )
 
 type Log struct {
 	ID     int64
 	Ts     string
+	Time   time.Time
 	Doc    string
 	Fields []any
 }
 
+// Hit is a doc in the json search api, Fields are the selected fields by name.
+// Ts is the zoneless timestamp of the doc (the local time of the effie that sent it), formatted like on the search page.
+type Hit struct {
+	ID     int64          `json:"id"`
+	Ts     string         `json:"ts"`
+	Fields map[string]any `json:"fields,omitempty"`
+	Doc    jsontext.Value `json:"doc"`
+}
+
 type Config struct {
 	Port                int    `json:"Port"`
 	SQLConnectionString string `json:"sqlconnectionstring"`
 	SQLMaxConnections   int    `json:"sqlmaxconnections"`
+	Debug               bool   `json:"debug"`
+}
+
+// Cursor is the keyset position of a result page, both are docs.id values.
+// Before pages to older docs (id < Before), After to newer docs (id > After).
+type Cursor struct {
+	Before int
+	After  int
 }
 
-/* TODO:
- *  implement time based filtering for specific dates, e.g. ?st=20020101195959&et=2025xxxxx (or 2025.01.01 19:59:59)
- */
+// TimeRange restricts a search on docs.ts.
+// Start and End are absolute and take precedence over the relative Span (e.g. "30 minutes").
+type TimeRange struct {
+	Span  string
+	Start time.Time
+	End   time.Time
+}
 
 var db *sql.DB
 var logger *slog.Logger
@@ -45,7 +73,8 @@ var templates embed.FS
 
 func main() {
 	jote.ProfilingUntilTimeIfSet(30)
-	logger = jote.CreateLogger("stdout")
+	var loglvl *slog.LevelVar
+	logger, loglvl = jote.CreateLoggerWithLevel("stdout")
 
 	CONFIGLOCATION := os.Getenv("CONFIG")
 	if CONFIGLOCATION == "" {
@@ -53,6 +82,9 @@ func main() {
 	}
 	config := Config{}
 	jote.ReadConfigYAML(CONFIGLOCATION, &config)
+	if config.Debug {
+		loglvl.Set(slog.LevelDebug)
+	}
 
 	var err error
 	db, err = sql.Open("postgres", config.SQLConnectionString)
@@ -64,50 +96,264 @@ func main() {
 	RequestCounter := atomic.Uint64{}
 	jote.AddMetrics(mux, "kagero", &RequestCounter)
 
-	tmpl := template.Must(template.ParseFS(templates, "templates/*"))
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{"highlight": highlight}).ParseFS(templates, "templates/*"))
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		jote.ExecuteTemplate(tmpl, w, "search", jote.H{})
 	})
 
 	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
-		query := r.FormValue("q")
-		page := getNumFromRequest(w, r, "p")
-		perpage := getNumFromRequest(w, r, "m")
-		if page == -1 || perpage == -1 {
-			return
+		search, err := parseSearch(r)
+		var logs []Log
+		var more bool
+		if err == nil {
+			//timestamps, counts := getRowCountForGraphic(r.Context(), timespan)
+			logs, more, err = getRows(r.Context(), search)
 		}
-		timespan := r.FormValue("t")
-		if !IsValidTimespan(timespan) {
-			http.Error(w, "ERROR: invalid timespan", 400)
+		if err != nil {
+			writeSearchError(w, r, tmpl, err)
 			return
 		}
-		_fields := r.FormValue("f")
-		fields := []string{"_meta.host", "message"}
-		if _fields != "" {
-			fields = strings.Split(_fields, ",")
-		}
-		//timestamps, counts := getRowCountForGraphic(r.Context(), timespan)
+		older, newer := getPageLinks(r, logs, search.Cursor, more)
 		jote.ExecuteTemplate(tmpl, w, "search", jote.H{
-			"list":   getRows(r.Context(), query, fields, page, perpage),
-			"fields": fields,
+			"list":      logs,
+			"fields":    search.Fields,
+			"older":     older,
+			"newer":     newer,
+			"highlight": getHighlightRegexp(search.Query),
 			//"bar_ts": timestamps,
 			//"bar_c":  counts,
 		})
 	})
 
 	mux.HandleFunc("GET /view", func(w http.ResponseWriter, r *http.Request) {
-		id := getNumFromRequest(w, r, "id")
-		if id == -1 || id == 0 {
+		id, err := getNumFromRequest(r, "id")
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), 400)
+			return
+		}
+		if id == 0 {
+			return
+		}
+		doc, err := getDoc(r.Context(), int64(id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "ERROR: doc not found", 404)
+			return
+		}
+		if err != nil {
+			logger.Error("error getting doc", "id", id, "err", err)
+			http.Error(w, "ERROR: "+dbErrorMessage, 500)
 			return
 		}
 		jote.ExecuteTemplate(tmpl, w, "view", jote.H{
-			"doc": getDoc(r.Context(), id),
+			"doc": doc,
+		})
+	})
+
+	mux.HandleFunc("GET /api/v1/search", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		search, err := parseSearch(r)
+		search.WithDoc = true
+		var logs []Log
+		var more bool
+		if err == nil {
+			logs, more, err = getRows(r.Context(), search)
+		}
+		if err != nil {
+			var qe *QueryError
+			if errors.As(err, &qe) {
+				writeJSON(w, 400, qe)
+			} else {
+				logger.Error("error searching docs", "err", err)
+				writeJSON(w, 500, jote.H{"error": dbErrorMessage})
+			}
+			return
+		}
+		hits := make([]Hit, len(logs))
+		for i, log := range logs {
+			hits[i] = Hit{ID: log.ID, Ts: log.Ts, Fields: map[string]any{}, Doc: rawDoc(log.Doc)}
+			for j, field := range search.Fields {
+				hits[i].Fields[strings.TrimSpace(field)] = log.Fields[j]
+			}
+		}
+		cursor := jote.H{"before": nil, "after": nil}
+		older, newer := getPageCursors(logs, search.Cursor, more)
+		if older > 0 {
+			cursor["before"] = older
+		}
+		if newer > 0 {
+			cursor["after"] = newer
+		}
+		writeJSON(w, 200, jote.H{
+			"hits":    hits,
+			"cursor":  cursor,
+			"took_ms": float64(time.Since(start).Microseconds()) / 1000,
 		})
 	})
 
+	mux.HandleFunc("GET /api/v1/docs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		in := r.PathValue("id")
+		id, err := strconv.ParseInt(in, 10, 64)
+		if err != nil || id <= 0 {
+			writeJSON(w, 400, &QueryError{Param: "id", Value: in, End: len(in), Err: errors.New("id is not a valid doc id")})
+			return
+		}
+		doc, err := getDoc(r.Context(), id)
+		if err == sql.ErrNoRows {
+			writeJSON(w, 404, jote.H{"error": "doc not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("error getting doc", "id", id, "err", err)
+			writeJSON(w, 500, jote.H{"error": dbErrorMessage})
+			return
+		}
+		writeJSON(w, 200, Hit{ID: doc.ID, Ts: doc.Ts, Doc: rawDoc(doc.Doc)})
+	})
+
 	jote.RunMux(":"+strconv.Itoa(config.Port), jote.AddLoggingToMuxWithCounter(mux, logger, &RequestCounter), logger)
 }
 
+// Search is a validated search request.
+type Search struct {
+	Query   string
+	Fields  []string
+	Range   TimeRange
+	Cursor  Cursor
+	PerPage int
+	// WithDoc selects the whole doc too (for the json api)
+	WithDoc bool
+}
+
+// parseSearch reads and validates the search parameters of the request, the returned errors are *QueryError.
+// The query and fields are validated when the sql is built.
+func parseSearch(r *http.Request) (Search, error) {
+	search := Search{Query: r.FormValue("q"), Fields: []string{"_meta.host", "message"}}
+	// the positions of query errors are only tracked for valid UTF-8
+	for _, key := range []string{"q", "f"} {
+		if !utf8.ValidString(r.FormValue(key)) {
+			return search, newParamError(r, key, "invalid UTF-8")
+		}
+	}
+	var err error
+	if search.Cursor.Before, err = getNumFromRequest(r, "before"); err != nil {
+		return search, err
+	}
+	if search.Cursor.After, err = getNumFromRequest(r, "after"); err != nil {
+		return search, err
+	}
+	if search.PerPage, err = getNumFromRequest(r, "m"); err != nil {
+		return search, err
+	}
+	if search.Cursor.Before > 0 && search.Cursor.After > 0 {
+		return search, newParamError(r, "after", "only one of before and after can be set")
+	}
+	search.Range.Span = r.FormValue("t")
+	if search.Range.Start, err = getTimeFromRequest(r, "st"); err != nil {
+		return search, err
+	}
+	if search.Range.End, err = getTimeFromRequest(r, "et"); err != nil {
+		return search, err
+	}
+	tr := search.Range
+	if (tr.Span != "" || (tr.Start.IsZero() && tr.End.IsZero())) && !IsValidTimespan(tr.Span) {
+		return search, newParamError(r, "t", "invalid timespan")
+	}
+	if f := r.FormValue("f"); f != "" {
+		search.Fields = strings.Split(f, ",")
+	}
+	return search, nil
+}
+
+// QueryError is an invalid search parameter. Pos and End are the byte range of the error in Value, the value of
+// the parameter Param.
+type QueryError struct {
+	Param string
+	Value string
+	Pos   int
+	End   int
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	return e.Param + ": " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// newParamError returns a QueryError for the whole value of the parameter.
+func newParamError(r *http.Request, key string, msg string) *QueryError {
+	value := r.FormValue(key)
+	return &QueryError{Param: key, Value: value, End: len(value), Err: errors.New(msg)}
+}
+
+// Before, Mark and After split Value around the error for highlighting.
+func (e *QueryError) Before() string { pos, _ := e.bounds(); return e.Value[:pos] }
+func (e *QueryError) Mark() string   { pos, end := e.bounds(); return e.Value[pos:end] }
+func (e *QueryError) After() string  { _, end := e.bounds(); return e.Value[end:] }
+
+// bounds returns Pos and End clamped to Value, so a wrong position can't panic while the error is shown.
+func (e *QueryError) bounds() (int, int) {
+	end := min(max(e.End, 0), len(e.Value))
+	return min(max(e.Pos, 0), end), end
+}
+
+// Start and Stop are Pos and End in UTF-16 code units, like javascript's setSelectionRange expects them.
+func (e *QueryError) Start() int { return len(utf16.Encode([]rune(e.Before()))) }
+func (e *QueryError) Stop() int  { return e.Start() + len(utf16.Encode([]rune(e.Mark()))) }
+
+func (e *QueryError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error string `json:"error"`
+		Param string `json:"param"`
+		Start int    `json:"start"`
+		End   int    `json:"end"`
+	}{e.Err.Error(), e.Param, e.Start(), e.Stop()})
+}
+
+// rawDoc returns the doc as json, null if the doc is null.
+func rawDoc(doc string) jsontext.Value {
+	if doc == "" {
+		return jsontext.Value("null")
+	}
+	return jsontext.Value(doc)
+}
+
+// dbErrorMessage is shown instead of database errors, they are only logged.
+const dbErrorMessage = "error querying the database"
+
+// writeSearchError answers invalid searches (QueryError) with a 400 and every other error, which is from the database,
+// with a 500. The error is rendered in the search page or as json if the client accepts it.
+func writeSearchError(w http.ResponseWriter, r *http.Request, tmpl *template.Template, err error) {
+	wantsJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	var qe *QueryError
+	if !errors.As(err, &qe) {
+		logger.Error("error searching docs", "err", err)
+		if wantsJSON {
+			writeJSON(w, 500, jote.H{"error": dbErrorMessage})
+		} else {
+			http.Error(w, "ERROR: "+dbErrorMessage, 500)
+		}
+		return
+	}
+	if wantsJSON {
+		writeJSON(w, 400, qe)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(400)
+	jote.ExecuteTemplate(tmpl, w, "search", jote.H{"error": qe})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.MarshalWrite(w, v); err != nil {
+		logger.Error("error writing json response", "err", err)
+	}
+}
+
 func IsValidTimespan(timespan string) bool {
 	arr := strings.Split(timespan, " ")
 	if len(arr) != 2 {
@@ -116,46 +362,77 @@ func IsValidTimespan(timespan string) bool {
 	if _, err := strconv.Atoi(arr[0]); err != nil {
 		return false
 	}
-	t := arr[1]
-	if t != "minutes" && t != "days" && t != "seconds" && t != "hours" {
+	t := strings.TrimSuffix(arr[1], "s")
+	if t != "minute" && t != "day" && t != "second" && t != "hour" {
 		return false
 	}
 	return true
 }
 
-func getNumFromRequest(w http.ResponseWriter, r *http.Request, key string) int {
+var timeFormats = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006.01.02 15:04:05", "20060102150405"}
+
+// Parses an absolute timestamp (e.g. from a datetime-local input) from the request.
+// Returns a zero time if the key is not set.
+func getTimeFromRequest(r *http.Request, key string) (time.Time, error) {
 	in := r.FormValue(key)
-	ret := 0
-	var err error
+	if in == "" {
+		return time.Time{}, nil
+	}
+	for _, format := range timeFormats {
+		if t, err := time.Parse(format, in); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, newParamError(r, key, key+" is not a valid timestamp")
+}
 
+func getNumFromRequest(r *http.Request, key string) (int, error) {
+	in := r.FormValue(key)
 	if in == "" {
-		return 0
+		return 0, nil
 	}
-	ret, err = strconv.Atoi(in)
+	ret, err := strconv.Atoi(in)
 	if err != nil {
-		http.Error(w, "ERROR: "+key+" is not a number", 400)
-		return -1
+		return 0, newParamError(r, key, key+" is not a number")
 	}
 	if ret < 0 {
-		http.Error(w, "ERROR: "+key+" is < 0", 400)
-		return -1
+		return 0, newParamError(r, key, key+" is < 0")
 	}
-	return ret
+	return ret, nil
 }
 
-func getDoc(ctx context.Context, id int) Log {
+// Returns sql.ErrNoRows if there is no doc with the id.
+func getDoc(ctx context.Context, id int64) (Log, error) {
 	var log Log
-	jote.Must(db.QueryRowContext(ctx, "SELECT id,ts,doc FROM docs WHERE id=$1", id).Scan(&log.ID, &log.Ts, &log.Doc))
-	return log
+	var doc sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT id,ts,doc FROM docs WHERE id=$1", id).Scan(&log.ID, &log.Time, &doc)
+	log.Doc = doc.String
+	log.Ts = log.Time.Format("2006-01-02 15:04:05.000")
+	return log, err
 }
 
-func getRows(ctx context.Context, query string, fields []string, page int, maxperpage int) []Log {
+// Returns the page of docs (newest first) and if there are more docs in the paging direction.
+// Invalid queries or fields are returned as *QueryError, every other error is from the database.
+func getRows(ctx context.Context, search Search) ([]Log, bool, error) {
 	var logs []Log
-	rows, err := doSearchSql(ctx, query, fields, page, maxperpage)
-	jote.Must(err)
+	maxperpage := max(min(search.PerPage, 500), 10)
+	// one more than needed to know if there is another page
+	query, args, err := createSearchSql(search, maxperpage+1)
+	if err != nil {
+		return nil, false, err
+	}
+	if logger.Enabled(ctx, slog.LevelDebug) {
+		logQueryPlan(ctx, query, args)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
 	defer rows.Close()
 	columns, err := rows.Columns()
-	jote.Must(err)
+	if err != nil {
+		return nil, false, err
+	}
 	for rows.Next() {
 		vals := make([]any, len(columns))
 		ptrs := make([]any, len(columns))
@@ -163,16 +440,70 @@ func getRows(ctx context.Context, query string, fields []string, page int, maxpe
 			ptrs[i] = &vals[i]
 		}
 		log := Log{}
-		jote.Must(rows.Scan(ptrs...))
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, false, err
+		}
 		log.ID = vals[0].(int64)
-		log.Ts = vals[1].(time.Time).Format("2006-01-02 15:04:05.000")
-		log.Fields = make([]any, len(columns)-2)
-		copy(log.Fields, vals[2:])
+		log.Time = vals[1].(time.Time)
+		log.Ts = log.Time.Format("2006-01-02 15:04:05.000")
+		fields := vals[2:]
+		if search.WithDoc {
+			if doc, ok := fields[len(fields)-1].([]byte); ok {
+				log.Doc = string(doc)
+			}
+			fields = fields[:len(fields)-1]
+		}
+		log.Fields = make([]any, len(fields))
+		copy(log.Fields, fields)
 		logs = append(logs, log)
 	}
-	jote.Must(rows.Err())
-	jote.Must(rows.Close())
-	return logs
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(logs) > maxperpage
+	if more {
+		logs = logs[:maxperpage]
+	}
+	if search.Cursor.After > 0 {
+		slices.Reverse(logs)
+	}
+	return logs, more, nil
+}
+
+// Returns the links to the next older and newer page, empty if there is none.
+func getPageLinks(r *http.Request, logs []Log, cur Cursor, more bool) (string, string) {
+	link := func(key string, id int64) string {
+		if id == 0 {
+			return ""
+		}
+		q := r.URL.Query()
+		q.Del("before")
+		q.Del("after")
+		q.Set(key, strconv.FormatInt(id, 10))
+		return "search?" + q.Encode()
+	}
+	older, newer := getPageCursors(logs, cur, more)
+	return link("before", older), link("after", newer)
+}
+
+// Returns the before cursor of the next older and the after cursor of the next newer page, 0 if there is none.
+func getPageCursors(logs []Log, cur Cursor, more bool) (int64, int64) {
+	var older, newer int64
+	if len(logs) == 0 {
+		if cur.Before > 0 {
+			newer = int64(cur.Before - 1)
+		} else if cur.After > 0 {
+			older = int64(cur.After + 1)
+		}
+		return older, newer
+	}
+	if more || cur.After > 0 {
+		older = logs[len(logs)-1].ID
+	}
+	if cur.Before > 0 || (cur.After > 0 && more) {
+		newer = logs[0].ID
+	}
+	return older, newer
 }
 
 /*
@@ -218,26 +549,98 @@ func getRowCountForGraphic(ctx context.Context, timespan string) (string, string
 }
 */
 
-func doSearchSql(ctx context.Context, query string, fields []string, page int, maxperpage int) (*sql.Rows, error) {
-	maxperpage = max(min(maxperpage, 500), 10)
-	// page = max(min(page, 5), 0)
-	selectSql := getSelectSqlFromFields(fields)
-	if query == "" {
-		return db.QueryContext(ctx, selectSql+" FROM docs ORDER BY id DESC LIMIT $1", maxperpage)
+// createSearchSql returns the sql and its arguments for the search, errors are *QueryError.
+func createSearchSql(search Search, limit int) (string, []any, error) {
+	cur := search.Cursor
+	selectSql, err := getSelectSqlFromFields(search.Fields)
+	if err != nil {
+		return "", nil, err
+	}
+	if search.WithDoc {
+		selectSql += ", doc"
+	}
+	where, args := createSqlTimeClause(search.Range)
+	order := " ORDER BY id DESC"
+	if cur.Before > 0 {
+		args = append(args, cur.Before)
+		where = append(where, "id < $"+strconv.Itoa(len(args)))
+	} else if cur.After > 0 {
+		args = append(args, cur.After)
+		where = append(where, "id > $"+strconv.Itoa(len(args)))
+		order = " ORDER BY id ASC"
 	}
-	whereClause, args := createSqlWhereClause(query)
-	return db.QueryContext(ctx, selectSql+" FROM docs WHERE "+whereClause+" ORDER BY id DESC LIMIT "+strconv.Itoa(maxperpage), args...)
+	if search.Query != "" {
+		whereClause, whereArgs, err := createSqlWhereClause(search.Query, len(args)+1)
+		if err != nil {
+			return "", nil, err
+		}
+		if whereClause != "" {
+			where = append(where, "("+whereClause+" )")
+			args = append(args, whereArgs...)
+		}
+	}
+	args = append(args, limit)
+	whereSql := ""
+	if len(where) > 0 {
+		whereSql = " WHERE " + strings.Join(where, " AND ")
+	}
+	return selectSql + " FROM docs" + whereSql + order + " LIMIT $" + strconv.Itoa(len(args)), args, nil
+}
+
+// logQueryPlan logs the plan postgres chose for the query, to see if the indexes are used.
+func logQueryPlan(ctx context.Context, query string, args []any) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		logger.Debug("error explaining query", "err", err)
+		return
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			logger.Debug("error explaining query", "err", err)
+			return
+		}
+		plan = append(plan, line)
+	}
+	logger.Debug("Query plan", "sql", query, "plan", strings.Join(plan, "\n"))
+}
+
+// Returns the conditions on docs.ts for the time range, absolute start/end win over the relative span.
+func createSqlTimeClause(tr TimeRange) ([]string, []any) {
+	where := []string{}
+	args := []any{}
+	if !tr.Start.IsZero() || !tr.End.IsZero() {
+		if !tr.Start.IsZero() {
+			args = append(args, tr.Start.Format("2006-01-02 15:04:05"))
+			where = append(where, "ts >= $"+strconv.Itoa(len(args)))
+		}
+		if !tr.End.IsZero() {
+			args = append(args, tr.End.Format("2006-01-02 15:04:05"))
+			where = append(where, "ts <= $"+strconv.Itoa(len(args)))
+		}
+		return where, args
+	}
+	if tr.Span != "" {
+		args = append(args, tr.Span)
+		where = append(where, "ts > CURRENT_TIMESTAMP - $"+strconv.Itoa(len(args))+"::interval")
+	}
+	return where, args
 }
 
 var alphaAndDotOnly = regexp.MustCompile(`^[_\.a-zA-Z0-9]+$`)
 
-func getSelectSqlFromFields(fields []string) string {
+func getSelectSqlFromFields(fields []string) (string, error) {
 	selectSql := "SELECT id, ts"
+	pos := 0
 	for _, _field := range fields {
 		field := strings.TrimSpace(_field)
 		if !alphaAndDotOnly.MatchString(field) {
-			panic("error: field of f has invalid value: " + field)
+			return "", &QueryError{Param: "f", Value: strings.Join(fields, ","), Pos: pos, End: pos + len(_field),
+				Err: fmt.Errorf("invalid field %q, only letters, digits, _ and . are allowed", field)}
 		}
+		pos += len(_field) + 1
 		qs := "doc"
 		fs := strings.Split(field, ".")
 		for i, key := range fs {
@@ -251,45 +654,435 @@ func getSelectSqlFromFields(fields []string) string {
 	}
 	//return "SELECT id, ts, doc->'_meta'->>'host' as host, doc->>'message' as message"
 	logger.Debug("SelectSQL build from fields", "sql", selectSql)
-	return selectSql
+	return selectSql, nil
 }
 
 // SELECT * FROM docs WHERE ts > '2026-01-08T19:03:03'
 // SELECT date_trunc('hour', ts) AS time_bucket, COUNT(*) AS row_count FROM docs GROUP BY time_bucket ORDER BY time_bucket
 
-func createSqlWhereClause(input string) (string, []any) {
-	exprGroup, err := fexpr.Parse(input)
+// createSqlWhereClause translates the search input to sql, errors are *QueryError.
+func createSqlWhereClause(input string, argc int) (string, []any, error) {
+	exprGroup, err := parseQuery(input)
+	if err != nil {
+		return "", nil, err
+	}
+	where, args, _, err := createSqlWhereClauseLoop(exprGroup, "", []any{}, argc)
 	if err != nil {
-		panic(err)
+		var qe *QueryError
+		if errors.As(err, &qe) {
+			qe.Value = input
+		}
+		return "", nil, err
 	}
-	where, args, _ := createSqlWhereClauseLoop(exprGroup, "", []any{}, 1)
 	logger.Debug("WhereSQL build from input", "sql", where)
-	return where, args
+	return where, args, nil
 }
 
-func createSqlWhereClauseLoop(eg []fexpr.ExprGroup, where string, args []any, argc int) (string, []any, int) {
+func createSqlWhereClauseLoop(eg []fexpr.ExprGroup, where string, args []any, argc int) (string, []any, int, error) {
 	for i, e := range eg {
+		// the join of an item is the one between it and the previous item
+		if i > 0 {
+			where = where + " " + parserJoinToPG(e.Join)
+		}
 		item := e.Item
 		switch i := item.(type) {
-		case fexpr.Expr:
-			where = where + " doc#>>$" + strconv.Itoa(argc) + string(i.Op) + "$" + strconv.Itoa(argc+1)
-			args = append(args, parserKeyToPG(i.Left.Literal))
-			args = append(args, i.Right.Literal)
-			argc += 2
+		case QueryExpr:
+			if i.Op == SignFullText {
+				where = where + " " + fullTextDocument + " @@ phraseto_tsquery('simple', $" + strconv.Itoa(argc) + ")"
+				args = append(args, i.Left.Literal)
+				argc++
+				break
+			}
+			sql, exprArgs, err := createSqlComparison(i.Expr, argc)
+			if err != nil {
+				return "", nil, 0, &QueryError{Param: "q", Pos: i.Pos, End: i.End, Err: err}
+			}
+			where = where + " " + sql
+			args = append(args, exprArgs...)
+			argc += len(exprArgs)
 		case []fexpr.ExprGroup:
+			var err error
 			where = where + " ("
-			where, args, argc = createSqlWhereClauseLoop(i, where, args, argc)
+			where, args, argc, err = createSqlWhereClauseLoop(i, where, args, argc)
+			if err != nil {
+				return "", nil, 0, err
+			}
 			where = where + " )"
 		}
-		if len(eg) > 1 && i < len(eg)-1 {
-			where = where + " " + parserJoinToPG(e.Join)
+	}
+	return where, args, argc, nil
+}
+
+// createSqlComparison translates a fexpr comparison to sql, the left operand is the path of a doc field.
+// If the right operand is a number the field is compared numerically (numeric strings included), else as text.
+// ~ and !~ are case-insensitive contains, != and !~ also match docs without the field.
+// The any operators (?=, ?!=, ...) match if at least one element of a json array field matches.
+func createSqlComparison(e fexpr.Expr, argc int) (string, []any, error) {
+	for _, t := range []fexpr.Token{e.Left, e.Right} {
+		if t.Type == fexpr.TokenFunction {
+			return "", nil, fmt.Errorf("functions are not supported, got %s()", t.Literal)
+		}
+	}
+	if e.Left.Type == fexpr.TokenNumber {
+		return "", nil, fmt.Errorf("expected a field on the left of %s, got the number %s", e.Op, e.Left.Literal)
+	}
+	path := "$" + strconv.Itoa(argc) + "::text[]"
+	value := "$" + strconv.Itoa(argc+1)
+	args := []any{parserKeyToPG(e.Left.Literal), e.Right.Literal}
+	op := string(e.Op)
+	numeric := e.Right.Type == fexpr.TokenNumber
+	if op == "~" || op == "!~" || op == "?~" || op == "?!~" {
+		numeric = false
+		args[1] = likePattern(e.Right.Literal)
+	}
+	if numeric {
+		value += "::numeric"
+	}
+	isNull := e.Right.Type == fexpr.TokenIdentifier && e.Right.Literal == "null"
+	if keys, ok := containmentKeys(e.Left.Literal); ok {
+		if op == string(fexpr.SignAnyEq) && (!numeric || jsontext.Value(e.Right.Literal).IsValid()) {
+			// field?=x is the same as doc @> {"field":[x]}, which can use the GIN index on doc
+			var elem any = e.Right.Literal
+			if numeric {
+				elem = jsontext.Value(e.Right.Literal)
+			}
+			return "doc @> $" + strconv.Itoa(argc) + "::jsonb", []any{containmentDoc(keys, []any{elem})}, nil
+		}
+		if op == "=" && !numeric && !isNull {
+			return createSqlContainment(keys, e.Right.Literal, path, value, args, argc)
+		}
+	}
+	if op == string(fexpr.SignAnyEq) {
+		if !numeric {
+			value += "::text"
+		}
+		return "(doc#>" + path + ") @> jsonb_build_array(" + value + ")", args, nil
+	}
+	if base, ok := strings.CutPrefix(op, "?"); ok {
+		elements := "jsonb_array_elements_text(CASE WHEN jsonb_typeof(doc#>" + path + ") = 'array' THEN doc#>" + path + " END) e(v)"
+		cmp, err := sqlCompare("v", base, value, numeric)
+		if err != nil {
+			return "", nil, err
+		}
+		return "EXISTS (SELECT 1 FROM " + elements + " WHERE " + cmp + ")", args, nil
+	}
+	if isNull {
+		switch op {
+		case "=":
+			return "(doc#>>" + path + ") IS NULL", args[:1], nil
+		case "!=":
+			return "(doc#>>" + path + ") IS NOT NULL", args[:1], nil
+		}
+	}
+	cmp, err := sqlCompare("(doc#>>"+path+")", op, value, numeric)
+	return cmp, args, err
+}
+
+// createSqlContainment translates the text equality of a field to containment checks of every json value whose text
+// is the value (e.g. "true" for the string and the boolean), which can use the GIN index on doc.
+// The text comparison is kept, so the result is the same as without the containment checks.
+func createSqlContainment(keys []string, literal string, path string, value string, args []any, argc int) (string, []any, error) {
+	variants := []any{literal}
+	if literal == "true" || literal == "false" {
+		variants = append(variants, literal == "true")
+	}
+	if literal != "" && (literal[0] == '-' || (literal[0] >= '0' && literal[0] <= '9')) && jsontext.Value(literal).IsValid() {
+		variants = append(variants, jsontext.Value(literal))
+	}
+	var contains []string
+	for _, v := range variants {
+		args = append(args, containmentDoc(keys, v))
+		contains = append(contains, "doc @> $"+strconv.Itoa(argc+len(args)-1)+"::jsonb")
+	}
+	return "(" + strings.Join(contains, " OR ") + ") AND (doc#>>" + path + ") = " + value, args, nil
+}
+
+// containmentKeys splits the field into its keys, false if a key is an array index (containment can't express those).
+func containmentKeys(field string) ([]string, bool) {
+	keys := strings.Split(field, ".")
+	for _, key := range keys {
+		if _, err := strconv.Atoi(key); err == nil || key == "" {
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// containmentDoc returns the json of value nested in objects of the keys, e.g. {"_meta":{"group":"k8s"}}.
+func containmentDoc(keys []string, value any) string {
+	for i := len(keys) - 1; i >= 0; i-- {
+		value = map[string]any{keys[i]: value}
+	}
+	j, err := json.Marshal(value)
+	jote.Must(err)
+	return string(j)
+}
+
+// sqlCompare compares the text field with the value (a placeholder), numerically if numeric is set.
+func sqlCompare(field string, op string, value string, numeric bool) (string, error) {
+	if numeric {
+		field = sqlNumeric(field)
+	}
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+		return field + " " + op + " " + value, nil
+	case "!=":
+		return field + " IS DISTINCT FROM " + value, nil
+	case "~":
+		return field + " ILIKE " + value, nil
+	case "!~":
+		return "COALESCE(" + field + ", '') NOT ILIKE " + value, nil
+	}
+	return "", fmt.Errorf("unsupported operator %q", op)
+}
+
+// sqlNumeric is the numeric value of the text field, NULL if it is not a number.
+func sqlNumeric(field string) string {
+	return "(CASE WHEN " + field + ` ~ '^\s*-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?\s*$' THEN (` + field + ")::numeric END)"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// likePattern returns the ILIKE pattern that matches values containing s.
+func likePattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// SignFullText marks a free-text term (a bare word or a quoted phrase) of the search input.
+const SignFullText fexpr.SignOp = "@@"
+
+// fullTextDocument has to be the same expression as the docs_fts_idx index of setsuna, else the index is not used.
+const fullTextDocument = `jsonb_to_tsvector('simple', doc, '["string"]')`
+
+const (
+	stepOperand = iota
+	stepSign
+	stepValue
+	stepJoin
+)
+
+// QueryExpr is a comparison or free-text term of the search input, Pos and End are its byte range in the input.
+type QueryExpr struct {
+	fexpr.Expr
+	Pos int
+	End int
+}
+
+// parseQuery parses the search input like fexpr.Parse, but an operand that is not followed by a sign operator
+// is a free-text term, e.g. `"connection refused" && _meta.group=k8s`.
+// The items are QueryExpr or []fexpr.ExprGroup, terms are QueryExpr with SignFullText and the term as Left.
+// Items without a join between them are joined with AND. Errors are *QueryError.
+func parseQuery(input string) ([]fexpr.ExprGroup, error) {
+	result, err := parseQueryAt(input, 0)
+	if err != nil {
+		var qe *QueryError
+		if errors.As(err, &qe) {
+			qe.Value = input
+		}
+	}
+	return result, err
+}
+
+// parseQueryAt parses input, which starts at offset in the whole search input.
+func parseQueryAt(input string, offset int) ([]fexpr.ExprGroup, error) {
+	result := []fexpr.ExprGroup{}
+	scanner := fexpr.NewScanner([]byte(input))
+	step := stepOperand
+	join := fexpr.JoinAnd
+	var expr QueryExpr
+	end := 0
+	queryError := func(pos, end int, err error) *QueryError {
+		return &QueryError{Param: "q", Pos: offset + pos, End: offset + min(end, len(input)), Err: err}
+	}
+	for {
+		pos := end
+		t, err := scanner.Scan()
+		end = pos + rawTokenLen(input, pos, t)
+		if err != nil {
+			return nil, queryError(pos, end, err)
+		}
+		if t.Type == fexpr.TokenWS || t.Type == fexpr.TokenComment {
+			continue
+		}
+		if step == stepSign && t.Type != fexpr.TokenSign {
+			expr.Op = SignFullText
+			result = append(result, fexpr.ExprGroup{Join: join, Item: expr})
+			step = stepJoin
+		}
+		if t.Type == fexpr.TokenEOF {
+			break
+		}
+		if step == stepJoin && t.Type != fexpr.TokenJoin {
+			join = fexpr.JoinAnd
+			step = stepOperand
+		}
+		switch step {
+		case stepOperand:
+			if t.Type == fexpr.TokenGroup {
+				group, err := parseQueryAt(t.Literal, offset+pos+1)
+				if err != nil {
+					return nil, err
+				}
+				if len(group) > 0 {
+					result = append(result, fexpr.ExprGroup{Join: join, Item: group})
+				}
+				step = stepJoin
+				continue
+			}
+			if !isOperand(t) {
+				return nil, queryError(pos, end, fmt.Errorf("expected a term or left operand (identifier, function, text or number), got %q", t.Literal))
+			}
+			expr = QueryExpr{Expr: fexpr.Expr{Left: t}, Pos: offset + pos, End: offset + end}
+			step = stepSign
+		case stepSign:
+			expr.Op = fexpr.SignOp(t.Literal)
+			step = stepValue
+		case stepValue:
+			if !isOperand(t) {
+				return nil, queryError(pos, end, fmt.Errorf("expected right operand (identifier, function, text or number), got %q", t.Literal))
+			}
+			expr.Right = t
+			expr.End = offset + end
+			result = append(result, fexpr.ExprGroup{Join: join, Item: expr})
+			step = stepJoin
+		case stepJoin:
+			join = fexpr.JoinAnd
+			if t.Literal == "||" {
+				join = fexpr.JoinOr
+			}
+			step = stepOperand
+		}
+	}
+	// a trailing join or a comparison without right operand
+	if step == stepValue || (step == stepOperand && len(result) > 0) {
+		return nil, queryError(len(input), len(input), fexpr.ErrIncomplete)
+	}
+	return result, nil
+}
+
+// rawTokenLen returns the length of the token t starting at pos in input, as the fexpr scanner doesn't track positions.
+func rawTokenLen(input string, pos int, t fexpr.Token) int {
+	rest := input[min(pos, len(input)):]
+	switch t.Type {
+	case fexpr.TokenText:
+		// up to the unescaped closing quote
+		var prev byte
+		for i := 1; i < len(rest); i++ {
+			if rest[i] == rest[0] && prev != '\\' {
+				return i + 1
+			}
+			prev = rest[i]
+		}
+		return len(rest)
+	case fexpr.TokenGroup, fexpr.TokenFunction:
+		// up to the matching closing bracket, brackets in quoted text don't count
+		depth := 0
+		var quote, prev byte
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			switch {
+			case quote != 0:
+				if c == quote && prev != '\\' {
+					quote = 0
+				}
+			case c == '"' || c == '\'':
+				quote = c
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			prev = c
+		}
+		return len(rest)
+	case fexpr.TokenComment:
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			return i + 1
+		}
+		return len(rest)
+	}
+	return min(len(t.Literal), len(rest))
+}
+
+func isOperand(t fexpr.Token) bool {
+	return t.Type == fexpr.TokenIdentifier || t.Type == fexpr.TokenText || t.Type == fexpr.TokenNumber || t.Type == fexpr.TokenFunction
+}
+
+// Returns the free-text terms of the search input, empty if it is invalid.
+func getFullTextTerms(input string) []string {
+	eg, err := parseQuery(input)
+	if err != nil {
+		return nil
+	}
+	var terms []string
+	var walk func(eg []fexpr.ExprGroup)
+	walk = func(eg []fexpr.ExprGroup) {
+		for _, e := range eg {
+			switch i := e.Item.(type) {
+			case QueryExpr:
+				if i.Op == SignFullText {
+					terms = append(terms, i.Left.Literal)
+				}
+			case []fexpr.ExprGroup:
+				walk(i)
+			}
+		}
+	}
+	walk(eg)
+	return terms
+}
+
+var nonWordRunes = regexp.MustCompile(`[^\pL\pN]+`)
+
+// Returns a regexp matching the free-text terms of the search input (case-insensitive, words of phrases separated
+// by any non-word characters like the full-text search does), nil if there are none.
+func getHighlightRegexp(input string) *regexp.Regexp {
+	var alts []string
+	for _, term := range getFullTextTerms(input) {
+		var words []string
+		for _, word := range nonWordRunes.Split(term, -1) {
+			if word != "" {
+				words = append(words, regexp.QuoteMeta(word))
+			}
+		}
+		if len(words) > 0 {
+			alts = append(alts, strings.Join(words, `[^\pL\pN]+`))
+		}
+	}
+	if len(alts) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(alts, "|"))
+}
+
+// highlight HTML escapes the value and wraps the matches of re that are whole words in <mark>.
+func highlight(value any, re *regexp.Regexp) template.HTML {
+	s := fmt.Sprintf("%s", value)
+	if re == nil {
+		return template.HTML(template.HTMLEscapeString(s))
+	}
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringIndex(s, -1) {
+		before, _ := utf8.DecodeLastRuneInString(s[:m[0]])
+		after, _ := utf8.DecodeRuneInString(s[m[1]:])
+		if isWord(before) || isWord(after) {
+			continue
 		}
+		b.WriteString(template.HTMLEscapeString(s[last:m[0]]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(s[m[0]:m[1]]) + "</mark>")
+		last = m[1]
 	}
-	return where, args, argc
+	b.WriteString(template.HTMLEscapeString(s[last:]))
+	return template.HTML(b.String())
 }
 
-func parserKeyToPG(key string) string {
-	return "{" + strings.ReplaceAll(key, ".", ",") + "}"
+func parserKeyToPG(key string) any {
+	return pq.Array(strings.Split(key, "."))
 }
 
 func parserJoinToPG(joinOp fexpr.JoinOp) string {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json/v2"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestCreateSqlWhereClause(t *testing.T) {
+	logger = slog.Default()
+	key := func(keys ...string) any { return pq.Array(keys) }
+	num := func(field string) string {
+		return `(CASE WHEN ` + field + ` ~ '^\s*-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?\s*$' THEN (` + field + `)::numeric END)`
+	}
+	elements := `jsonb_array_elements_text(CASE WHEN jsonb_typeof(doc#>$1::text[]) = 'array' THEN doc#>$1::text[] END) e(v)`
+	tests := []struct {
+		query string
+		sql   string
+		args  []any
+	}{
+		// text equality uses containment, the text comparison is kept
+		{`level=error`, ` (doc @> $3::jsonb) AND (doc#>>$1::text[]) = $2`, []any{key("level"), "error", `{"level":"error"}`}},
+		{`_meta.group="k8s"`, ` (doc @> $3::jsonb) AND (doc#>>$1::text[]) = $2`, []any{key("_meta", "group"), "k8s", `{"_meta":{"group":"k8s"}}`}},
+		{`ok=true`, ` (doc @> $3::jsonb OR doc @> $4::jsonb) AND (doc#>>$1::text[]) = $2`, []any{key("ok"), "true", `{"ok":"true"}`, `{"ok":true}`}},
+		{`code='42'`, ` (doc @> $3::jsonb OR doc @> $4::jsonb) AND (doc#>>$1::text[]) = $2`, []any{key("code"), "42", `{"code":"42"}`, `{"code":42}`}},
+		{`tags.0=x`, ` (doc#>>$1::text[]) = $2`, []any{key("tags", "0"), "x"}},
+		// numbers are compared numerically
+		{`status=500`, ` ` + num(`(doc#>>$1::text[])`) + ` = $2::numeric`, []any{key("status"), "500"}},
+		{`status!=500`, ` ` + num(`(doc#>>$1::text[])`) + ` IS DISTINCT FROM $2::numeric`, []any{key("status"), "500"}},
+		{`status<500`, ` ` + num(`(doc#>>$1::text[])`) + ` < $2::numeric`, []any{key("status"), "500"}},
+		{`status<=500`, ` ` + num(`(doc#>>$1::text[])`) + ` <= $2::numeric`, []any{key("status"), "500"}},
+		{`took>1.5`, ` ` + num(`(doc#>>$1::text[])`) + ` > $2::numeric`, []any{key("took"), "1.5"}},
+		{`took>=-2`, ` ` + num(`(doc#>>$1::text[])`) + ` >= $2::numeric`, []any{key("took"), "-2"}},
+		// text comparisons
+		{`level!=error`, ` (doc#>>$1::text[]) IS DISTINCT FROM $2`, []any{key("level"), "error"}},
+		{`ts<"2024-01-02"`, ` (doc#>>$1::text[]) < $2`, []any{key("ts"), "2024-01-02"}},
+		{`ts<='2024'`, ` (doc#>>$1::text[]) <= $2`, []any{key("ts"), "2024"}},
+		{`name>m`, ` (doc#>>$1::text[]) > $2`, []any{key("name"), "m"}},
+		{`name>=m`, ` (doc#>>$1::text[]) >= $2`, []any{key("name"), "m"}},
+		// contains, with the like wildcards and the escape character escaped
+		{`message~timeout`, ` (doc#>>$1::text[]) ILIKE $2`, []any{key("message"), "%timeout%"}},
+		{`message~'50%_off\x'`, ` (doc#>>$1::text[]) ILIKE $2`, []any{key("message"), `%50\%\_off\\x%`}},
+		{`message!~timeout`, ` COALESCE((doc#>>$1::text[]), '') NOT ILIKE $2`, []any{key("message"), "%timeout%"}},
+		{`status~50`, ` (doc#>>$1::text[]) ILIKE $2`, []any{key("status"), "%50%"}},
+		// null
+		{`user=null`, ` (doc#>>$1::text[]) IS NULL`, []any{key("user")}},
+		{`user!=null`, ` (doc#>>$1::text[]) IS NOT NULL`, []any{key("user")}},
+		// any operators on arrays
+		{`tags?=prod`, ` doc @> $1::jsonb`, []any{`{"tags":["prod"]}`}},
+		{`codes?=5`, ` doc @> $1::jsonb`, []any{`{"codes":[5]}`}},
+		{`list.0?=x`, ` (doc#>$1::text[]) @> jsonb_build_array($2::text)`, []any{key("list", "0"), "x"}},
+		{`tags?!=prod`, ` EXISTS (SELECT 1 FROM ` + elements + ` WHERE v IS DISTINCT FROM $2)`, []any{key("tags"), "prod"}},
+		{`codes?>5`, ` EXISTS (SELECT 1 FROM ` + elements + ` WHERE ` + num("v") + ` > $2::numeric)`, []any{key("codes"), "5"}},
+		{`tags?~pro`, ` EXISTS (SELECT 1 FROM ` + elements + ` WHERE v ILIKE $2)`, []any{key("tags"), "%pro%"}},
+		// joins, groups and full-text terms
+		{
+			`status>=500 && (level=error || host!=web)`,
+			` ` + num(`(doc#>>$1::text[])`) + ` >= $2::numeric AND ( (doc @> $5::jsonb) AND (doc#>>$3::text[]) = $4 OR (doc#>>$6::text[]) IS DISTINCT FROM $7 )`,
+			[]any{key("status"), "500", key("level"), "error", `{"level":"error"}`, key("host"), "web"},
+		},
+		{
+			`(a=null || (b!=1 && c~x)) || d=null`,
+			` ( (doc#>>$1::text[]) IS NULL OR ( ` + num(`(doc#>>$2::text[])`) + ` IS DISTINCT FROM $3::numeric AND (doc#>>$4::text[]) ILIKE $5 ) ) OR (doc#>>$6::text[]) IS NULL`,
+			[]any{key("a"), key("b"), "1", key("c"), "%x%", key("d")},
+		},
+		{
+			`"connection refused" level!=debug`,
+			` jsonb_to_tsvector('simple', doc, '["string"]') @@ phraseto_tsquery('simple', $1) AND (doc#>>$2::text[]) IS DISTINCT FROM $3`,
+			[]any{"connection refused", key("level"), "debug"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			sql, args, err := createSqlWhereClause(tt.query, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.sql {
+				t.Errorf("sql\n got: %s\nwant: %s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args\n got: %#v\nwant: %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestCreateSqlWhereClauseErrors(t *testing.T) {
+	logger = slog.Default()
+	for _, query := range []string{`5=status`, `lower(level)=error`, `level=`, `(level=error`} {
+		t.Run(query, func(t *testing.T) {
+			if sql, _, err := createSqlWhereClause(query, 1); err == nil {
+				t.Errorf("expected an error, got %s", sql)
+			}
+		})
+	}
+}
+
+func TestQueryErrorInvalidUTF8(t *testing.T) {
+	logger = slog.Default()
+	// the positions of the tokens drift on invalid UTF-8, showing the error must not panic
+	_, _, err := createSqlWhereClause("(\"0\x9e\"!)", 1)
+	var qe *QueryError
+	if !errors.As(err, &qe) {
+		t.Fatalf("expected a QueryError, got %v", err)
+	}
+	_ = qe.Before() + qe.Mark() + qe.After()
+	if _, err := json.Marshal(qe); err != nil {
+		t.Error(err)
+	}
+
+	r := httptest.NewRequest("GET", "/?q=%28%220%9E%22%21%29", nil)
+	if _, err := parseSearch(r); !errors.As(err, &qe) || qe.Param != "q" {
+		t.Errorf("expected a QueryError for q, got %v", err)
+	}
+}
@@ -3,8 +3,8 @@ module setsuna
 go 1.25.5
 
 require (
-	github.com/coreos/go-systemd/v22 v22.6.0
 	github.com/httmako/jote v0.1.5
+	github.com/klauspost/compress v1.20.1
 	github.com/lib/pq v1.10.9
 )
 
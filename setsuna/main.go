@@ -1,19 +1,32 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json/jsontext"
 	"encoding/json/v2"
-	"strings"
-	// "fmt"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/httmako/jote"
+	"github.com/klauspost/compress/zstd"
 	"github.com/lib/pq"
 )
 
@@ -31,6 +44,23 @@ type Config struct {
 	CleanupInterval     int       `json:"cleanupinterval"`
 	CleanupMaxAgeAll    string    `json:"cleanupmaxageall"`
 	CleanupConfig       []Cleanup `json:"cleanupconfig"`
+	PartitionInterval   string    `json:"partitioninterval"`
+	PartitionPrecreate  int       `json:"partitionprecreate"`
+	MaxBodySize         int64     `json:"maxbodysize"`
+	MaxDecompressedSize int64     `json:"maxdecompressedsize"`
+	TLSCert             string    `json:"tlscert"`
+	TLSKey              string    `json:"tlskey"`
+	TLSClientCA         string    `json:"tlsclientca"`
+	TokenHeader         string    `json:"tokenheader"`
+	Tokens              []Token   `json:"tokens"`
+}
+
+// Token authenticates a collector (effie) on the ingest endpoint.
+// Either Token (plain text) or Hash (hex sha256 of the token) has to be set.
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Hash  string `json:"hash"`
 }
 
 type Cleanup struct {
@@ -60,61 +90,340 @@ func main() {
 	db.SetMaxOpenConns(config.SQLMaxConnections)
 	// go func(){ for { fmt.Println(db.Stats()) time.Sleep(3*time.Second) } }()
 
-	jote.Must2(db.Exec("CREATE TABLE IF NOT EXISTS docs(id BIGSERIAL, ts TIMESTAMP, doc jsonb)"))
-	jote.Must2(db.Exec("CREATE INDEX IF NOT EXISTS id ON docs (id)"))
-	jote.Must2(db.Exec("CREATE INDEX IF NOT EXISTS j ON docs USING GIN (doc)"))
-
+	if config.PartitionInterval == "" {
+		config.PartitionInterval = "day"
+	}
+	if config.PartitionPrecreate < 1 {
+		config.PartitionPrecreate = 3
+	}
+	if config.MaxBodySize < 1 {
+		config.MaxBodySize = 100 << 20
+	}
+	if config.MaxDecompressedSize < 1 {
+		config.MaxDecompressedSize = 500 << 20
+	}
+	SetupDocsTable(config)
+	SetupFullTextIndex()
+	go DoPartitionMaintenanceForever(config)
 	go DoCleanupForever(config)
 
+	if config.TokenHeader == "" {
+		config.TokenHeader = "Authorization"
+	}
+	tokenHashes := HashTokens(config.Tokens)
+	if len(tokenHashes) == 0 {
+		logger.Warn("no tokens configured, ingest endpoint is not authenticated")
+	}
+
 	mux := http.NewServeMux()
 	RequestCounter := atomic.Uint64{}
-	jote.AddMetrics(mux, "setsuna", &RequestCounter)
+	RejectedCounter := atomic.Uint64{}
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "# TYPE setsuna_http_requests_total counter\nsetsuna_http_requests_total "+strconv.FormatUint(RequestCounter.Load(), 10)+
+			"\n# TYPE setsuna_auth_rejected_total counter\nsetsuna_auth_rejected_total "+strconv.FormatUint(RejectedCounter.Load(), 10)+"\n")
+	})
 
 	mux.HandleFunc("POST /v1/effie/logs", func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		if err != nil || len(body) < 1 {
-			logger.Error("error reading body", "ip", jote.HttpRequestGetIP(r), "err", err)
+		collector, ok := Authenticate(r, config.TokenHeader, tokenHashes)
+		if !ok {
+			RejectedCounter.Add(1)
+			logger.Warn("rejected request with invalid token", "ip", jote.HttpRequestGetIP(r))
+			writeJSON(w, 401, jote.H{"error": "invalid token"})
+			return
+		}
+		body, err := DecompressBody(w, r, config)
+		if err != nil {
+			ie := &IngestError{Status: 400, Index: -1, Err: err}
+			errors.As(err, &ie)
+			logger.Error("error decompressing body", "ip", jote.HttpRequestGetIP(r), "collector", collector, "status", ie.Status, "err", ie.Err)
+			writeJSON(w, ie.Status, jote.H{"error": ie.Err.Error()})
 			return
 		}
-		saveEffieLogs(r, body)
+		defer body.Close()
+		count, err := saveEffieLogs(r.Context(), body)
+		if err != nil {
+			ie := &IngestError{Status: 500, Index: -1, Err: err}
+			errors.As(err, &ie)
+			logger.Error("error saving logs", "ip", jote.HttpRequestGetIP(r), "collector", collector, "status", ie.Status, "index", ie.Index, "err", ie.Err)
+			res := jote.H{"error": ie.Err.Error()}
+			if ie.Index >= 0 {
+				res["index"] = ie.Index
+			}
+			writeJSON(w, ie.Status, res)
+			return
+		}
+		writeJSON(w, 200, jote.H{"accepted": count})
 	})
 
-	jote.RunMux(":"+strconv.Itoa(config.Port), jote.AddLoggingToMuxWithCounter(mux, logger, &RequestCounter), logger)
+	handler := jote.AddLoggingToMuxWithCounter(mux, logger, &RequestCounter)
+	if config.TLSCert != "" {
+		RunMuxTLS(":"+strconv.Itoa(config.Port), handler, config)
+	} else {
+		jote.RunMux(":"+strconv.Itoa(config.Port), handler, logger)
+	}
 }
 
-func saveEffieLogs(r *http.Request, input []byte) {
-	js := []map[string]any{}
-	jote.Must(json.Unmarshal(input, &js))
-	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{})
-	jote.Must(err)
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Warn("Rolling back saveArray because of panic", "err", r)
-			tx.Rollback()
+// RunMuxTLS is the same as [jote.RunMux] but serves https with the configured certificate.
+// If TLSClientCA is set every client has to present a certificate signed by it (mutual TLS).
+func RunMuxTLS(addr string, mux http.Handler, config Config) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSClientCA != "" {
+		pem, err := os.ReadFile(config.TLSClientCA)
+		jote.Must(err)
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic("no certificates found in " + config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	logger.Info("Now listening with tls", "addr", addr, "mtls", config.TLSClientCA != "")
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        mux,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		IdleTimeout:    10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+		<-sigint
+		logger.Info("Signal received, shutting down...")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logger.Error("Error at httpServer.Shutdown", "err", err)
 		}
+		close(idleConnsClosed)
 	}()
+
+	if err := srv.ListenAndServeTLS(config.TLSCert, config.TLSKey); err != http.ErrServerClosed {
+		logger.Error("Error at ListenAndServeTLS", "err", err)
+	}
+
+	<-idleConnsClosed
+}
+
+// HashTokens returns the sha256 hashes of all configured tokens mapped to the collector name.
+func HashTokens(tokens []Token) map[string]string {
+	hashes := map[string]string{}
+	for _, t := range tokens {
+		if t.Hash != "" {
+			hashes[strings.ToLower(t.Hash)] = t.Name
+		} else if t.Token != "" {
+			sum := sha256.Sum256([]byte(t.Token))
+			hashes[hex.EncodeToString(sum[:])] = t.Name
+		} else {
+			logger.Warn("ignoring token without token or hash", "name", t.Name)
+		}
+	}
+	return hashes
+}
+
+// Authenticate checks the token in header against the hashed tokens and returns the collector name.
+// The "Bearer " prefix is removed from the token. Every request is allowed if no tokens are configured.
+func Authenticate(r *http.Request, header string, hashes map[string]string) (string, bool) {
+	if len(hashes) == 0 {
+		return "", true
+	}
+	token := strings.TrimPrefix(r.Header.Get(header), "Bearer ")
+	if token == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for h, name := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// DecompressBody returns the body decompressed according to the Content-Encoding header (gzip or zstd).
+// The compressed body is capped at MaxBodySize and the decompressed one at MaxDecompressedSize,
+// exceeding either returns a [http.MaxBytesError] while reading. Errors are [IngestError]s with
+// status 415 for an unknown Content-Encoding and 400 for a body that can't be decoded.
+func DecompressBody(w http.ResponseWriter, r *http.Request, config Config) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(w, r.Body, config.MaxBodySize)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, decodeError(err, -1)
+		}
+		return http.MaxBytesReader(w, gz, config.MaxDecompressedSize), nil
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+		if err != nil {
+			return nil, decodeError(err, -1)
+		}
+		return http.MaxBytesReader(w, zr.IOReadCloser(), config.MaxDecompressedSize), nil
+	default:
+		return nil, &IngestError{Status: 415, Index: -1, Err: errors.New("unsupported content-encoding " + r.Header.Get("Content-Encoding"))}
+	}
+}
+
+// IngestError is returned by saveEffieLogs with the http status for the client.
+// Index is the position of the offending log in the array, -1 if unknown.
+type IngestError struct {
+	Status int
+	Index  int
+	Err    error
+}
+
+func (e *IngestError) Error() string {
+	return e.Err.Error()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.MarshalWrite(w, v); err != nil {
+		logger.Error("error writing json response", "err", err)
+	}
+}
+
+// Returns a 413 if the body was too large and a 400 for every other decoding error.
+func decodeError(err error, index int) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &IngestError{Status: 413, Index: -1, Err: err}
+	}
+	return &IngestError{Status: 400, Index: index, Err: err}
+}
+
+var copyLine = regexp.MustCompile(`COPY docs, line (\d+)`)
+
+// Returns a 400 for data errors (e.g. invalid ts) in the logs and a 503 for every other database error.
+func dbError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23") {
+		index := -1
+		if m := copyLine.FindStringSubmatch(pqErr.Where); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			index = line - 1
+		}
+		return &IngestError{Status: 400, Index: index, Err: err}
+	}
+	return &IngestError{Status: 503, Index: -1, Err: err}
+}
+
+// saveEffieLogs decodes the json array of logs token by token and copies every log into the db as soon as it is read.
+// Only ts and doc are read from each log, every other key is skipped without decoding it.
+// Returns the number of saved logs, nothing is saved if an error is returned.
+func saveEffieLogs(ctx context.Context, input io.Reader) (int, error) {
+	dec := jsontext.NewDecoder(input)
+	if err := expectToken(dec, '['); err == io.EOF {
+		return 0, &IngestError{Status: 400, Index: -1, Err: errors.New("empty body")}
+	} else if err != nil {
+		return 0, decodeError(err, -1)
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer tx.Rollback()
 	stmt, err := tx.Prepare(pq.CopyIn("docs", "ts", "doc"))
-	jote.Must(err)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer stmt.Close()
 
 	t := time.Now().Format("2006-01-02 15:04:05.999")
-	for _, j := range js {
-		jote.Must2(stmt.ExecContext(r.Context(),
-			getKeyOrDefault(j, "ts", t),
-			getKeyOrDefault(j, "doc", "<NO/DOC>"),
-		))
-	}
-	jote.Must2(stmt.Exec())
-	jote.Must(stmt.Close())
-	jote.Must(tx.Commit())
+	count := 0
+	for dec.PeekKind() != ']' {
+		ts, doc, err := readLog(dec, t)
+		if err != nil {
+			return 0, decodeError(err, count)
+		}
+		if _, err := stmt.ExecContext(ctx, ts, doc); err != nil {
+			return 0, dbError(err)
+		}
+		count++
+	}
+	if err := expectToken(dec, ']'); err != nil {
+		return 0, decodeError(err, count)
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return 0, dbError(err)
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, dbError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, dbError(err)
+	}
+	return count, nil
+}
+
+// Reads a single log object and returns its ts (defaulting to now) and doc.
+func readLog(dec *jsontext.Decoder, now string) (string, string, error) {
+	ts, doc := now, "<NO/DOC>"
+	if err := expectToken(dec, '{'); err != nil {
+		return ts, doc, err
+	}
+	for dec.PeekKind() != '}' {
+		name, err := dec.ReadToken()
+		if err != nil {
+			return ts, doc, err
+		}
+		switch name.String() {
+		case "ts":
+			ts, err = readStringOrDefault(dec, ts)
+		case "doc":
+			doc, err = readDoc(dec, doc)
+		default:
+			err = dec.SkipValue()
+		}
+		if err != nil {
+			return ts, doc, err
+		}
+	}
+	return ts, doc, expectToken(dec, '}')
+}
+
+func expectToken(dec *jsontext.Decoder, kind jsontext.Kind) error {
+	tok, err := dec.ReadToken()
+	if err != nil {
+		return err
+	}
+	if tok.Kind() != kind {
+		return fmt.Errorf("invalid json, expected %s but got %s at offset %d", kind, tok.Kind(), dec.InputOffset())
+	}
+	return nil
 }
 
-func getKeyOrDefault(j map[string]any, key string, def string) string {
-	if v, ok := j[key]; ok {
-		if s, ok := v.(string); ok {
-			return s
+// Reads the next value if it is a string, else skips it and returns def.
+func readStringOrDefault(dec *jsontext.Decoder, def string) (string, error) {
+	if dec.PeekKind() != '"' {
+		return def, dec.SkipValue()
+	}
+	tok, err := dec.ReadToken()
+	if err != nil {
+		return def, err
+	}
+	return tok.String(), nil
+}
+
+// Reads the doc, which is a json string from effie. Objects and arrays are taken as raw json.
+func readDoc(dec *jsontext.Decoder, def string) (string, error) {
+	switch dec.PeekKind() {
+	case '{', '[':
+		val, err := dec.ReadValue()
+		if err != nil {
+			return def, err
 		}
+		return string(val), nil
+	default:
+		return readStringOrDefault(dec, def)
 	}
-	return def
 }
 
 func DoCleanupForever(config Config) {
@@ -139,16 +448,234 @@ func DoCleanupForever(config Config) {
 		}
 		if config.CleanupMaxAgeAll != "" {
 			logger.Info("cleaning all logs", "CleanupMaxAgeAll", config.CleanupMaxAgeAll)
-			res, err := db.Exec("DELETE FROM docs WHERE ts < CURRENT_TIMESTAMP - INTERVAL '" + config.CleanupMaxAgeAll + "'")
-			if err != nil {
-				logger.Error("error during cleanup db.Exec", "err", err)
-			} else {
-				count, err := res.RowsAffected()
-				logger.Info("cleaned all logs", "count", count, "err", err)
-			}
+			DropExpiredPartitions(config)
 		} else {
 			logger.Info("config CleanupMaxAgeAll missing, skipping")
 		}
 		logger.Info("cleanup finished")
 	}
 }
+
+// Partition is a range partition of docs, Upper is the exclusive upper bound of its ts range.
+type Partition struct {
+	Name  string
+	Upper time.Time
+}
+
+// SetupDocsTable creates the docs table partitioned by range on ts, plus a default partition for rows outside of all ranges.
+// An old unpartitioned docs table is migrated by attaching it as the "docs_legacy" partition.
+// The current and upcoming partitions are created before it returns, so no batch has to land in the default partition.
+func SetupDocsTable(config Config) {
+	var kind string
+	err := db.QueryRow("SELECT relkind FROM pg_class WHERE oid = to_regclass('docs')").Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	if kind != "p" {
+		createOrMigrateDocsTable(config, kind)
+	}
+	jote.Must(CreatePartitions(config))
+}
+
+func createOrMigrateDocsTable(config Config, kind string) {
+	tx, err := db.Begin()
+	jote.Must(err)
+	defer tx.Rollback()
+	if kind == "r" {
+		logger.Warn("migrating unpartitioned docs table to docs_legacy partition, this can take a while")
+		var maxTs sql.NullTime
+		jote.Must(tx.QueryRow("SELECT max(ts) FROM docs").Scan(&maxTs))
+		upper := PartitionStart(config.PartitionInterval, WallClock(time.Now()))
+		if maxTs.Valid && !WallClock(maxTs.Time).Before(upper) {
+			upper = PartitionNext(config.PartitionInterval, PartitionStart(config.PartitionInterval, WallClock(maxTs.Time)))
+		}
+		jote.Must2(tx.Exec("ALTER TABLE docs RENAME TO docs_legacy"))
+		jote.Must2(tx.Exec("ALTER TABLE docs_legacy ALTER COLUMN ts SET NOT NULL"))
+		createDocsTable(tx)
+		jote.Must2(tx.Exec("ALTER TABLE docs ATTACH PARTITION docs_legacy FOR VALUES FROM (MINVALUE) TO ('" + upper.Format(time.DateTime) + "')"))
+	} else {
+		jote.Must2(tx.Exec("CREATE SEQUENCE IF NOT EXISTS docs_id_seq"))
+		createDocsTable(tx)
+	}
+	jote.Must(tx.Commit())
+}
+
+func createDocsTable(tx *sql.Tx) {
+	// the sequence of the old BIGSERIAL column is reused so ids stay unique across the migration
+	jote.Must2(tx.Exec("CREATE TABLE docs(id BIGINT NOT NULL DEFAULT nextval('docs_id_seq'), ts TIMESTAMP NOT NULL, doc jsonb) PARTITION BY RANGE (ts)"))
+	jote.Must2(tx.Exec("ALTER SEQUENCE docs_id_seq OWNED BY docs.id"))
+	jote.Must2(tx.Exec("CREATE INDEX docs_id_idx ON docs (id)"))
+	jote.Must2(tx.Exec("CREATE INDEX docs_doc_idx ON docs USING GIN (doc)"))
+	jote.Must2(tx.Exec("CREATE TABLE docs_default PARTITION OF docs DEFAULT"))
+}
+
+// FullTextDocument is the tsvector of all string values of a doc, kagero's full-text search has to use the same expression
+// so the docs_fts_idx index is used.
+const FullTextDocument = `jsonb_to_tsvector('simple', doc, '["string"]')`
+
+// SetupFullTextIndex creates the index for the full-text search of kagero, this can take a while on existing installs.
+func SetupFullTextIndex() {
+	var exists bool
+	jote.Must(db.QueryRow("SELECT to_regclass('docs_fts_idx') IS NOT NULL").Scan(&exists))
+	if exists {
+		return
+	}
+	logger.Info("creating full-text index on docs, this can take a while")
+	jote.Must2(db.Exec("CREATE INDEX IF NOT EXISTS docs_fts_idx ON docs USING GIN (" + FullTextDocument + ")"))
+}
+
+// WallClock returns the date and clock time of t in UTC without converting it.
+// docs.ts and the partition bounds have no time zone, postgres returns them as UTC, so every time that is compared
+// with them has to be a wall clock time in UTC as well (e.g. WallClock(time.Now()) for the local time ts is written in).
+func WallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// PartitionStart truncates t to the start of its partition.
+func PartitionStart(interval string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch interval {
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// PartitionNext returns the start of the partition after the one starting at start.
+func PartitionNext(interval string, start time.Time) time.Time {
+	switch interval {
+	case "month":
+		return start.AddDate(0, 1, 0)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+var partitionUpperBound = regexp.MustCompile(`TO \('([^']+)'\)`)
+
+// ListPartitions returns all range partitions of docs, the default partition is not included.
+func ListPartitions() ([]Partition, error) {
+	rows, err := db.Query("SELECT c.relname, pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'docs'::regclass")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parts := []Partition{}
+	var name, bound string
+	for rows.Next() {
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		m := partitionUpperBound.FindStringSubmatch(bound)
+		if m == nil {
+			continue
+		}
+		// the bound has no time zone, it is parsed as UTC like WallClock
+		upper, err := time.Parse(time.DateTime, m[1])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, Partition{Name: name, Upper: upper})
+	}
+	return parts, rows.Err()
+}
+
+// CreatePartitions creates the partitions from the current one up to PartitionPrecreate partitions in the future.
+// Ranges that are already covered by an existing partition are skipped.
+func CreatePartitions(config Config) error {
+	parts, err := ListPartitions()
+	if err != nil {
+		return fmt.Errorf("listing partitions: %w", err)
+	}
+	var covered time.Time
+	for _, p := range parts {
+		if p.Upper.After(covered) {
+			covered = p.Upper
+		}
+	}
+	start := PartitionStart(config.PartitionInterval, WallClock(time.Now()))
+	for i := 0; i <= config.PartitionPrecreate; i++ {
+		end := PartitionNext(config.PartitionInterval, start)
+		if !start.Before(covered) {
+			if err := createPartition(start, end); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// createPartition creates the partition for [start, end) in one transaction. Rows of the range that already landed in
+// the default partition are moved into it, else postgres refuses to create the partition.
+func createPartition(start, end time.Time) error {
+	name := "docs_p" + start.Format("20060102")
+	from, to := start.Format(time.DateTime), end.Format(time.DateTime)
+	logger.Info("creating partition", "name", name, "from", from, "to", to)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TABLE " + name + " (LIKE docs INCLUDING DEFAULTS INCLUDING CONSTRAINTS)"); err != nil {
+		return fmt.Errorf("creating partition %s: %w", name, err)
+	}
+	res, err := tx.Exec("WITH moved AS (DELETE FROM docs_default WHERE ts >= $1 AND ts < $2 RETURNING id, ts, doc) INSERT INTO "+name+" (id, ts, doc) SELECT id, ts, doc FROM moved", from, to)
+	if err != nil {
+		return fmt.Errorf("moving rows from docs_default to %s: %w", name, err)
+	}
+	if moved, _ := res.RowsAffected(); moved > 0 {
+		logger.Info("moved rows from default partition", "name", name, "rows", moved)
+	}
+	if _, err := tx.Exec("ALTER TABLE docs ATTACH PARTITION " + name + " FOR VALUES FROM ('" + from + "') TO ('" + to + "')"); err != nil {
+		return fmt.Errorf("attaching partition %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+// DropExpiredPartitions drops every partition whose whole range is older than CleanupMaxAgeAll.
+// Expired rows in the default partition are deleted.
+func DropExpiredPartitions(config Config) {
+	var cutoff time.Time
+	err := db.QueryRow("SELECT (CURRENT_TIMESTAMP - $1::interval)::timestamp", config.CleanupMaxAgeAll).Scan(&cutoff)
+	if err != nil {
+		logger.Error("error calculating cleanup cutoff", "err", err)
+		return
+	}
+	cutoff = WallClock(cutoff)
+	parts, err := ListPartitions()
+	if err != nil {
+		logger.Error("error listing partitions", "err", err)
+		return
+	}
+	for _, p := range parts {
+		if p.Upper.After(cutoff) {
+			continue
+		}
+		_, err := db.Exec("DROP TABLE " + pq.QuoteIdentifier(p.Name))
+		logger.Info("dropped expired partition", "name", p.Name, "upper", p.Upper, "err", err)
+	}
+	res, err := db.Exec("DELETE FROM docs_default WHERE ts < $1", cutoff.Format(time.DateTime))
+	if err != nil {
+		logger.Error("error during cleanup of default partition", "err", err)
+		return
+	}
+	count, err := res.RowsAffected()
+	logger.Info("cleaned default partition", "count", count, "err", err)
+}
+
+func DoPartitionMaintenanceForever(config Config) {
+	for {
+		// the partitions for now were already created by SetupDocsTable
+		time.Sleep(time.Hour)
+		if err := CreatePartitions(config); err != nil {
+			logger.Error("error creating partitions", "err", err)
+		}
+	}
+}